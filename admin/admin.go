@@ -0,0 +1,166 @@
+// Package admin is HTTP endpoint for troubleshooting of running proxy
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/AlexAkulov/statsd-ha-proxy/server"
+	"github.com/AlexAkulov/statsd-ha-proxy/tap"
+	"github.com/AlexAkulov/statsd-ha-proxy/upstreams"
+)
+
+// Server serves admin endpoints. /rejects returns last rejected lines and count of rejects per source.
+// /backends returns state of backends of every upstream with time of the next reconnect of broken ones.
+// /tap streams lines passing through the proxy, lines can be filtered by pattern, source or backend:
+//
+//	curl -N 'http://127.0.0.1:8126/tap?pattern=^app\.&source=10.0.0.1'
+type Server struct {
+	Listen  string
+	Log     *logger.Logger
+	Rejects *server.RejectLog
+	Tap     *tap.Tap
+	// Upstreams by name
+	Upstreams map[string]*upstreams.Upstream
+
+	done       chan struct{}
+	listener   net.Listener
+	httpServer *http.Server
+	wg         sync.WaitGroup
+}
+
+// Start admin server
+func (a *Server) Start() error {
+	if a.Log == nil {
+		a.Log = logger.Nop()
+	}
+	listener, err := net.Listen("tcp", a.Listen)
+	if err != nil {
+		return err
+	}
+	a.listener = listener
+	a.done = make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rejects", a.handleRejects)
+	mux.HandleFunc("/tap", a.handleTap)
+	mux.HandleFunc("/backends", a.handleBackends)
+	a.httpServer = &http.Server{Handler: mux}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		if err := a.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			a.Log.Error("Admin server fail", "listen", a.Listen, "error", err)
+		}
+	}()
+	a.Log.Info("Admin server is started", "listen", listener.Addr())
+	return nil
+}
+
+// Addr returns address of admin listener
+func (a *Server) Addr() net.Addr {
+	return a.listener.Addr()
+}
+
+// Stop admin server and wait for requests in progress
+func (a *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Streams of tap never end themselves
+	close(a.done)
+	err := a.httpServer.Shutdown(ctx)
+	a.wg.Wait()
+	return err
+}
+
+type rejectsResponse struct {
+	Lines   []server.Rejected `json:"lines"`
+	Sources map[string]uint64 `json:"sources"`
+}
+
+func (a *Server) handleRejects(w http.ResponseWriter, r *http.Request) {
+	if a.Rejects == nil {
+		http.Error(w, "rejects log is disabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, rejectsResponse{Lines: a.Rejects.Lines(), Sources: a.Rejects.Sources()})
+}
+
+func (a *Server) handleBackends(w http.ResponseWriter, r *http.Request) {
+	states := make(map[string][]upstreams.BackendState, len(a.Upstreams))
+	for name, u := range a.Upstreams {
+		states[name] = u.Backends()
+	}
+	writeJSON(w, states)
+}
+
+// tapQueueSize is count of lines which wait for slow tap client before they are dropped
+const tapQueueSize = 10000
+
+func (a *Server) handleTap(w http.ResponseWriter, r *http.Request) {
+	if a.Tap == nil {
+		http.Error(w, "tap is disabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	filter := tap.Filter{Source: query.Get("source"), Backend: query.Get("backend")}
+	if filter.Source != "" && filter.Backend != "" {
+		http.Error(w, "source and backend can't be used together", http.StatusBadRequest)
+		return
+	}
+	if pattern := query.Get("pattern"); pattern != "" {
+		var err error
+		if filter.Pattern, err = regexp.Compile(pattern); err != nil {
+			http.Error(w, fmt.Sprintf("bad pattern: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := a.Tap.Subscribe(filter, tapQueueSize)
+	defer a.Tap.Unsubscribe(sub)
+	a.Log.Info("Tap is attached", "remote", r.RemoteAddr, "query", r.URL.RawQuery)
+	defer a.Log.Info("Tap is detached", "remote", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	flushTicker := time.NewTicker(200 * time.Millisecond)
+	defer flushTicker.Stop()
+	var dropped uint64
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-r.Context().Done():
+			return
+		case line := <-sub.C:
+			if _, err := w.Write(append(line[:len(line):len(line)], '\n')); err != nil {
+				return
+			}
+		case <-flushTicker.C:
+			if d := sub.Dropped(); d != dropped {
+				fmt.Fprintf(w, "# %d lines are dropped, tap client is too slow\n", d-dropped)
+				dropped = d
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
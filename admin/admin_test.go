@@ -0,0 +1,275 @@
+package admin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+	"github.com/AlexAkulov/statsd-ha-proxy/server"
+	"github.com/AlexAkulov/statsd-ha-proxy/tap"
+	"github.com/AlexAkulov/statsd-ha-proxy/upstreams"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+// logBuffer is log output which is read while handlers write to it
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) count(s string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Count(b.buf.String(), s)
+}
+
+// startTestServer starts admin server with rejects log and tap, logs are written to the returned buffer
+func startTestServer(t *testing.T) (*Server, *logBuffer) {
+	logs := &logBuffer{}
+	log, err := logger.New(logs, logger.FormatText, logger.Debug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Server{Listen: "127.0.0.1:0", Log: log, Rejects: server.NewRejectLog(10), Tap: &tap.Tap{}}
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return a, logs
+}
+
+func (a *Server) url(path string) string {
+	return fmt.Sprintf("http://%s%s", a.Addr(), path)
+}
+
+func TestDisabled(t *testing.T) {
+	a := &Server{}
+	for path, handler := range map[string]http.HandlerFunc{"/rejects": a.handleRejects, "/tap": a.handleTap} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Disabled %s returns %d", path, w.Code)
+		}
+	}
+}
+
+func TestRejects(t *testing.T) {
+	a, _ := startTestServer(t)
+	defer a.Stop()
+	// Lines are rejected by statsd server which shares the log
+	s := &server.Server{
+		ConfigListen: "127.0.0.1:0",
+		Queue:        queue.New(0, 100),
+		Stats:        graphite.New("", nil),
+		Rejects:      a.Rejects,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	conn, err := net.Dial("udp", s.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("app.a:1|c\nbad line\napp.b:1|xyz")); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WaitFor(t, "rejected lines", func() bool { return len(a.Rejects.Lines()) == 2 })
+
+	resp, err := http.Get(a.url("/rejects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Content type is %s", resp.Header.Get("Content-Type"))
+	}
+	var result struct {
+		Lines []struct {
+			Listener, Proto, Source, Line, Reason string
+		}
+		Sources map[string]uint64
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Lines) != 2 || result.Lines[0].Line != "bad line" || result.Lines[1].Line != "app.b:1|xyz" {
+		t.Fatalf("Rejected lines are %+v", result.Lines)
+	}
+	if line := result.Lines[0]; line.Listener != server.ProtocolStatsd || line.Proto != "udp" || line.Source != "127.0.0.1" || line.Reason == "" {
+		t.Errorf("Rejected line is %+v", line)
+	}
+	if len(result.Sources) != 1 || result.Sources["127.0.0.1"] != 2 {
+		t.Errorf("Sources are %v", result.Sources)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	a, _ := startTestServer(t)
+	defer a.Stop()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	u := &upstreams.Upstream{
+		Stats:                    graphite.New("", nil),
+		Queue:                    queue.New(0, 100),
+		BackendsList:             []upstreams.BackendConfig{{Server: l.Addr().String(), Weight: 1}, {Server: "127.0.0.1:1", Weight: 1}},
+		BackendReconnectInterval: time.Hour,
+		BackendTimeout:           time.Second,
+	}
+	u.Start()
+	defer u.Stop()
+	a.Upstreams = map[string]*upstreams.Upstream{"statsd": u}
+
+	resp, err := http.Get(a.url("/backends"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result map[string][]upstreams.BackendState
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	states := result["statsd"]
+	if len(result) != 1 || len(states) != 2 {
+		t.Fatalf("Backends are %+v", result)
+	}
+	if !states[0].Alive || !states[0].Active || states[0].NextRetry != nil {
+		t.Errorf("Alive backend is %+v", states[0])
+	}
+	if states[1].Alive || states[1].Active || states[1].LastError == "" || states[1].NextRetry == nil {
+		t.Errorf("Broken backend is %+v", states[1])
+	}
+}
+
+func TestTapBadQuery(t *testing.T) {
+	a := &Server{Log: logger.Nop(), Tap: &tap.Tap{}}
+	for _, query := range []string{"source=10.0.0.1&backend=statsite1:8125", "pattern=[a"} {
+		w := httptest.NewRecorder()
+		a.handleTap(w, httptest.NewRequest("GET", "/tap?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Query [%s] returns %d", query, w.Code)
+		}
+	}
+}
+
+// openTap starts tap request and waits until it is attached
+func openTap(t *testing.T, a *Server, logs *logBuffer, query string) *http.Response {
+	attached := logs.count("Tap is attached")
+	resp, err := http.Get(a.url("/tap?" + query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Tap returns %d", resp.StatusCode)
+	}
+	testutil.WaitFor(t, "attached tap", func() bool { return logs.count("Tap is attached") > attached })
+	return resp
+}
+
+func TestTapFilter(t *testing.T) {
+	a, logs := startTestServer(t)
+	defer a.Stop()
+	resp := openTap(t, a, logs, `pattern=^app\.&source=10.0.0.1`)
+	defer resp.Body.Close()
+
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	a.Tap.Received([]byte("web.a:1|c"), client)
+	a.Tap.Received([]byte("app.a:1|c"), &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000})
+	a.Tap.Sent([]byte("app.b:1|c"), "statsite1:8125")
+	a.Tap.Received([]byte("app.c:1|c"), client)
+	// Lines are flushed by timer
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "app.c:1|c\n" {
+		t.Errorf("Tap line is [%s], expected only matched one", line)
+	}
+}
+
+func TestTapDisconnect(t *testing.T) {
+	a, logs := startTestServer(t)
+	defer a.Stop()
+	resp := openTap(t, a, logs, "")
+	resp.Body.Close()
+	// Handler sees closed connection and unsubscribes
+	testutil.WaitFor(t, "detached tap", func() bool {
+		a.Tap.Received([]byte("app.a:1|c"), nil)
+		return logs.count("Tap is detached") == 1
+	})
+}
+
+func TestTapSlowClient(t *testing.T) {
+	a, logs := startTestServer(t)
+	defer a.Stop()
+	resp := openTap(t, a, logs, "")
+	defer resp.Body.Close()
+
+	// Client doesn't read, so writes of handler block and queue of subscriber is filled up.
+	// Received never blocks, lines over the queue are dropped.
+	line := append(bytes.Repeat([]byte("a"), 1000), ":1|c"...)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*tapQueueSize; i++ {
+			a.Tap.Received(line, nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Slow tap client blocks lines")
+	}
+
+	// Client is told how many lines are lost when it catches up
+	scanner := bufio.NewScanner(resp.Body)
+	received := 0
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "#") {
+			if !strings.HasSuffix(scanner.Text(), "lines are dropped, tap client is too slow") {
+				t.Errorf("Bad comment [%s]", scanner.Text())
+			}
+			break
+		}
+		received++
+	}
+	if received == 0 || received >= 2*tapQueueSize {
+		t.Errorf("Client got %d of %d lines", received, 2*tapQueueSize)
+	}
+}
+
+func TestStopWithTap(t *testing.T) {
+	a, logs := startTestServer(t)
+	resp := openTap(t, a, logs, "")
+	defer resp.Body.Close()
+	stopped := make(chan struct{})
+	go func() {
+		a.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waits for tap stream")
+	}
+}
@@ -3,92 +3,357 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/op/go-logging"
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/AlexAkulov/statsd-ha-proxy/server"
+	"github.com/AlexAkulov/statsd-ha-proxy/upstreams"
 	"gopkg.in/yaml.v2"
 )
 
 type stats struct {
-	Enabled        bool   `yaml:"enabled"`
-	GraphiteURI    string `yaml:"graphite_uri"`
-	GraphitePrefix string `yaml:"graphite_prefix"`
+	Enabled        bool     `yaml:"enabled"`
+	GraphiteURI    string   `yaml:"graphite_uri"`
+	GraphitePrefix string   `yaml:"graphite_prefix"`
+	Interval       duration `yaml:"interval"`
+	Protocol       string   `yaml:"protocol"`
+	Path           string   `yaml:"path"`
+}
+
+type mirror struct {
+	Enabled    bool      `yaml:"enabled"`
+	Server     string    `yaml:"server"`
+	SampleRate float64   `yaml:"sample_rate"`
+	Pattern    string    `yaml:"pattern"`
+	CacheSize  cacheSize `yaml:"cache_size"`
+}
+
+// samplingRule forwards only rate part of matched lines and corrects their sample rate
+type samplingRule struct {
+	Pattern string   `yaml:"pattern"`
+	Rate    float64  `yaml:"rate"`
+	Types   []string `yaml:"types,omitempty"`
+}
+
+// filter is allow and deny lists of metric name regexps
+type filter struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// cardinality limits count of distinct metric names per prefix
+type cardinality struct {
+	Enabled       bool     `yaml:"enabled"`
+	PrefixDepth   int      `yaml:"prefix_depth"`
+	MaxNames      int      `yaml:"max_names"`
+	MaxPrefixes   int      `yaml:"max_prefixes"`
+	MaxTotalNames int      `yaml:"max_total_names"`
+	Window        duration `yaml:"window"`
+	Action        string   `yaml:"action"`
+}
+
+// acl is access control list of listener, networks are CIDRs or addresses.
+// Prefixes are names like "team_a.*" which clients of network may send.
+type acl struct {
+	Allow    []string            `yaml:"allow"`
+	Deny     []string            `yaml:"deny"`
+	Prefixes map[string][]string `yaml:"prefixes"`
+}
+
+// adminEndpoint is HTTP endpoint for troubleshooting
+type adminEndpoint struct {
+	Enabled       bool   `yaml:"enabled"`
+	Listen        string `yaml:"listen"`
+	RejectedLines int    `yaml:"rejected_lines"`
+}
+
+// carbonRelay is a listener of graphite plaintext protocol with its own group of upstreams
+type carbonRelay struct {
+	Enabled          bool                      `yaml:"enabled"`
+	Listen           string                    `yaml:"listen"`
+	Mode             string                    `yaml:"mode"`
+	Backends         []upstreams.BackendConfig `yaml:"servers"`
+	CacheSize        cacheSize                 `yaml:"cache_size"`
+	BackendQueueSize int                       `yaml:"backend_queue_size"`
+	ProxyProtocol    bool                      `yaml:"proxy_protocol"`
+	ProxyTrusted     []string                  `yaml:"proxy_protocol_trusted"`
+	SourceTag        string                    `yaml:"source_tag"`
+	SourcePrefix     bool                      `yaml:"source_prefix"`
+	SourceResolve    bool                      `yaml:"source_resolve"`
+	ACL              *acl                      `yaml:"acl"`
 }
 
 type config struct {
-	LogFile           string   `yaml:"log_file"`
-	LogLevel          string   `yaml:"log_level"`
-	Listen            string   `yaml:"listen"`
-	Backends          []string `yaml:"servers"`
-	Timeout           int64    `yaml:"timeout"`
-	ReconnectInterval int64    `yaml:"reconnect_interval"`
-	CacheSize         int64    `yaml:"cache_size"`
-	SwitchLatency     int64    `yaml:"switch_upstream_latency"`
-	Stats             *stats   `yaml:"stats"`
-}
-
-func printDefaultConfig() {
-	c := getDefaultConfig()
-	d, _ := yaml.Marshal(&c)
+	LogFile                   string                    `yaml:"log_file"`
+	LogLevel                  string                    `yaml:"log_level"`
+	LogFormat                 string                    `yaml:"log_format"`
+	LogMaxSize                byteSize                  `yaml:"log_max_size"`
+	LogMaxBackups             int                       `yaml:"log_max_backups"`
+	LogLevels                 map[string]string         `yaml:"log_levels"`
+	InvalidLinesLogRate       int                       `yaml:"invalid_lines_log_rate"`
+	Listen                    string                    `yaml:"listen"`
+	ProxyProtocol             bool                      `yaml:"proxy_protocol"`
+	ProxyTrusted              []string                  `yaml:"proxy_protocol_trusted"`
+	SourceTag                 string                    `yaml:"source_tag"`
+	SourcePrefix              bool                      `yaml:"source_prefix"`
+	SourceResolve             bool                      `yaml:"source_resolve"`
+	SourceDNSTTL              duration                  `yaml:"source_dns_ttl"`
+	SourceDNSCacheSize        int                       `yaml:"source_dns_cache_size"`
+	Mode                      string                    `yaml:"mode"`
+	Backends                  []upstreams.BackendConfig `yaml:"servers"`
+	BackendsFile              string                    `yaml:"servers_file"`
+	BackendsFileCheckInterval duration                  `yaml:"servers_file_check_interval"`
+	Timeout                   duration                  `yaml:"timeout"`
+	ReconnectInterval         duration                  `yaml:"reconnect_interval"`
+	ReconnectMaxInterval      duration                  `yaml:"reconnect_max_interval"`
+	CacheSize                 cacheSize                 `yaml:"cache_size"`
+	BackendQueueSize          int                       `yaml:"backend_queue_size"`
+	DegradedLatency           duration                  `yaml:"degraded_latency"`
+	DegradedQueue             float64                   `yaml:"degraded_queue"`
+	SwitchLatency             duration                  `yaml:"switch_upstream_latency"`
+	DiscoveryInterval         duration                  `yaml:"discovery_interval"`
+	Sampling                  []samplingRule            `yaml:"sampling"`
+	Filter                    *filter                   `yaml:"filter"`
+	ACL                       *acl                      `yaml:"acl"`
+	Cardinality               *cardinality              `yaml:"cardinality"`
+	Mirror                    *mirror                   `yaml:"mirror"`
+	Graphite                  *carbonRelay              `yaml:"graphite"`
+	Stats                     *stats                    `yaml:"stats"`
+	Admin                     *adminEndpoint            `yaml:"admin"`
+
+	// STATSD_HA_PROXY_* variables which aren't keys of config, they are logged as warnings
+	unknownEnv []string
+}
+
+// newResolver returns reverse DNS cache for a listener, nil if names of clients aren't resolved
+func (c *config) newResolver(enabled bool) *server.HostResolver {
+	if !enabled {
+		return nil
+	}
+	return &server.HostResolver{
+		TTL:      time.Duration(c.SourceDNSTTL),
+		MaxHosts: c.SourceDNSCacheSize,
+	}
+}
+
+// build returns ACL of listener, nil if lists are empty
+func (a *acl) build() (*server.ACL, error) {
+	if len(a.Allow) == 0 && len(a.Deny) == 0 && len(a.Prefixes) == 0 {
+		return nil, nil
+	}
+	result := &server.ACL{}
+	var err error
+	if result.Allow, err = parseNetworks(a.Allow); err != nil {
+		return nil, fmt.Errorf("Bad allow network: %v", err)
+	}
+	if result.Deny, err = parseNetworks(a.Deny); err != nil {
+		return nil, fmt.Errorf("Bad deny network: %v", err)
+	}
+	networks := make([]string, 0, len(a.Prefixes))
+	for network := range a.Prefixes {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	for _, network := range networks {
+		rule := server.PrefixRule{}
+		if rule.Network, err = server.ParseNetwork(network); err != nil {
+			return nil, fmt.Errorf("Bad prefixes network: %v", err)
+		}
+		if len(a.Prefixes[network]) == 0 {
+			return nil, fmt.Errorf("Prefixes of network [%s] are empty", network)
+		}
+		for _, pattern := range a.Prefixes[network] {
+			// Only "*" at the end is supported, so "team_a.*" is prefix "team_a."
+			prefix := strings.TrimSuffix(pattern, "*")
+			if prefix == "" || strings.Contains(prefix, "*") {
+				return nil, fmt.Errorf("Bad prefix [%s] of network [%s], expected name like team_a.*", pattern, network)
+			}
+			rule.Prefixes = append(rule.Prefixes, prefix)
+		}
+		result.Prefixes = append(result.Prefixes, rule)
+	}
+	return result, nil
+}
+
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, s := range networks {
+		network, err := server.ParseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func printConfig(c *config) {
+	d, _ := yaml.Marshal(c)
 	fmt.Print(string(d))
 }
 
 func getDefaultConfig() config {
 	return config{
-		LogFile:  "stdout",
-		LogLevel: "debug",
-		Listen:   ":8125",
-		Backends: []string{
-			"statsite1:8125",
-			"statsite2:8125",
+		LogFile:             "stdout",
+		LogLevel:            "debug",
+		LogFormat:           logger.FormatText,
+		LogMaxSize:          0,
+		LogMaxBackups:       5,
+		LogLevels:           map[string]string{},
+		InvalidLinesLogRate: 10,
+		Listen:              ":8125",
+		SourceDNSTTL:        duration(10 * time.Minute),
+		SourceDNSCacheSize:  10000,
+		Mode:                "priority",
+		Backends: []upstreams.BackendConfig{
+			{Server: "statsite1:8125", Weight: 1},
+			{Server: "statsite2:8125", Weight: 1},
+		},
+		Timeout:                   duration(time.Second),
+		ReconnectInterval:         duration(10 * time.Second),
+		ReconnectMaxInterval:      duration(5 * time.Minute),
+		CacheSize:                 cacheSize{Lines: 1000000},
+		BackendQueueSize:          1000,
+		DegradedLatency:           duration(100 * time.Millisecond),
+		DegradedQueue:             0,
+		SwitchLatency:             duration(10 * time.Second),
+		DiscoveryInterval:         duration(30 * time.Second),
+		BackendsFile:              "",
+		BackendsFileCheckInterval: duration(5 * time.Second),
+		Filter:                    &filter{},
+		ACL:                       &acl{},
+		Cardinality: &cardinality{
+			Enabled:       false,
+			PrefixDepth:   2,
+			MaxNames:      2000,
+			MaxPrefixes:   1000,
+			MaxTotalNames: 200000,
+			Window:        duration(10 * time.Minute),
+			Action:        "overflow",
+		},
+		Mirror: &mirror{
+			Enabled:    false,
+			Server:     "statsite-canary:8125",
+			SampleRate: 0.1,
+			Pattern:    "",
+			CacheSize:  cacheSize{Lines: 10000},
+		},
+		Graphite: &carbonRelay{
+			Enabled: false,
+			Listen:  ":2003",
+			Mode:    "priority",
+			Backends: []upstreams.BackendConfig{
+				{Server: "carbon-relay1:2003", Weight: 1},
+				{Server: "carbon-relay2:2003", Weight: 1},
+			},
+			CacheSize:        cacheSize{Lines: 1000000},
+			BackendQueueSize: 1000,
+			ACL:              &acl{},
 		},
-		// Time in milliseconds
-		Timeout:           1000,
-		ReconnectInterval: 10000,
-		CacheSize:         1000000,
-		SwitchLatency:     10000,
 		Stats: &stats{
 			Enabled:        false,
 			GraphiteURI:    "localhost:2003",
 			GraphitePrefix: "DevOps",
+			Interval:       duration(time.Minute),
+			Protocol:       statsTCP,
+			Path:           "{prefix}.statsite_proxy.{host}",
+		},
+		Admin: &adminEndpoint{
+			Enabled:       false,
+			Listen:        "127.0.0.1:8126",
+			RejectedLines: 1000,
 		},
 	}
 }
 
-func loadConfig(configPath string) (*config, error) {
+// loadConfig applies config file, STATSD_HA_PROXY_* environment variables and overrides like key=value
+// over default config, every next source wins. Config file isn't read when configPath is empty.
+func loadConfig(configPath string, overrides []string) (*config, error) {
 	config := getDefaultConfig()
+	if configPath != "" {
+		if err := config.readFile(configPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.applyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Bad override [%s], expected key=value", override)
+		}
+		if err := config.set(parts[0], parts[1]); err != nil {
+			return nil, fmt.Errorf("Bad override [%s] [%s]", override, err)
+		}
+	}
+	if err := config.validate(); err != nil {
+		if configPath == "" {
+			return nil, fmt.Errorf("Bad config [%s]", err)
+		}
+		return nil, fmt.Errorf("Bad config file [%s] [%s]", configPath, err)
+	}
+	return &config, nil
+}
+
+func (c *config) readFile(configPath string) error {
 	configYAML, err := ioutil.ReadFile(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("Can't open config file. %s", err)
+		return fmt.Errorf("Can't open config file. %s", err)
+	}
+	var raw interface{}
+	if err := yaml.Unmarshal(configYAML, &raw); err != nil {
+		return fmt.Errorf("Can't parse config file [%s] [%s]", configPath, err)
+	}
+	if err := checkUnknownKeys(raw, reflect.TypeOf(c), ""); err != nil {
+		return fmt.Errorf("Can't parse config file [%s] [%s]", configPath, err)
+	}
+	if err := yaml.Unmarshal(configYAML, c); err != nil {
+		return fmt.Errorf("Can't parse config file [%s] [%s]", configPath, err)
+	}
+	return nil
+}
+
+// Components which have their own log level
+const (
+	logServer    = "server"
+	logUpstreams = "upstreams"
+	logStats     = "stats"
+	logAdmin     = "admin"
+)
+
+// newLog returns logger and log file which should be reopened on SIGUSR1, file is nil for stdout
+func newLog(c *config) (*logger.Logger, *logger.File, error) {
+	logLevel, err := logger.ParseLevel(c.LogLevel)
+	if err != nil {
+		logLevel = logger.Debug
 	}
-	err = yaml.Unmarshal([]byte(configYAML), &config)
+	if c.LogFile == "stdout" || c.LogFile == "" {
+		log, err := logger.New(os.Stdout, c.LogFormat, logLevel)
+		return log, nil, err
+	}
+	logFile, err := logger.OpenFile(c.LogFile, int64(c.LogMaxSize), c.LogMaxBackups)
 	if err != nil {
-		return nil, fmt.Errorf("Can't parse config file [%s] [%s]", configPath, err)
+		return nil, nil, fmt.Errorf("Can't open log file %s: %s", c.LogFile, err.Error())
 	}
-	return &config, nil
+	log, err := logger.New(logFile, c.LogFormat, logLevel)
+	return log, logFile, err
 }
 
-func newLog(logFile, level string) (*logging.Logger, error) {
-	logLevel, err := logging.LogLevel(level)
+// componentLog returns logger of component with level from log_levels or log_level
+func (c *config) componentLog(log *logger.Logger, component string) *logger.Logger {
+	level, ok := c.LogLevels[component]
+	if !ok {
+		level = c.LogLevel
+	}
+	logLevel, err := logger.ParseLevel(level)
 	if err != nil {
-		logLevel = logging.DEBUG
-	}
-	var logBackend *logging.LogBackend
-	if logFile == "stdout" || logFile == "" {
-		logBackend = logging.NewLogBackend(os.Stdout, "", 0)
-		logBackend.Color = true
-	} else {
-		logFileName := logFile
-		logFile, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-		if err != nil {
-			return nil, fmt.Errorf("Can't open log file %s: %s", logFileName, err.Error())
-		}
-		logBackend = logging.NewLogBackend(logFile, "", 0)
-	}
-	logging.SetFormatter(logging.MustStringFormatter("%{time:2006-01-02 15:04:05}\t%{level}\t%{message}"))
-	logger := logging.MustGetLogger("module")
-	leveledLogBackend := logging.AddModuleLevel(logBackend)
-	leveledLogBackend.SetLevel(logLevel, "module")
-	logger.SetBackend(leveledLogBackend)
-	return logger, nil
+		logLevel = logger.Debug
+	}
+	return log.Component(component, logLevel)
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs main with arguments from mainArgsEnv, so exit codes of the binary are tested
+func TestMain(m *testing.M) {
+	if args := os.Getenv(mainArgsEnv); args != "" {
+		os.Args = append([]string{os.Args[0]}, strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Name is out of STATSD_HA_PROXY_* variables, they are applied to config
+const mainArgsEnv = "TEST_MAIN_ARGS"
+
+// writeConfig writes config file to a temporary directory and returns its path, the directory should be removed
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "statsd-ha-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateConfig(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config string
+		// Empty if config is valid
+		err string
+	}{
+		{"empty", "", ""},
+		{"unknown key", "listen2: :8125", "Unknown key [listen2]"},
+		{"unknown nested key", "stats:\n  enable: true", "Unknown key [stats.enable]"},
+		{"unknown key in list", "sampling:\n  - pattern: ^a\\.\n    rate: 0.5\n    type: [ms]", "Unknown key [sampling.0.type]"},
+		{"unknown key in servers map", "servers:\n  - address: a:8125\n    wieght: 2", "Unknown key [servers.0.wieght]"},
+		{"unknown key in graphite servers map", "graphite:\n  servers:\n    - a:2003\n    - address: b:2003\n      conections: 2", "Unknown key [graphite.servers.1.conections]"},
+		{"bad proxy protocol trusted network", "proxy_protocol: true\nproxy_protocol_trusted: [10.0.0.0/33]", "Bad proxy_protocol_trusted"},
+		{"bad graphite proxy protocol trusted network", "graphite:\n  enabled: true\n  proxy_protocol_trusted: [lb]", "Bad graphite proxy_protocol_trusted"},
+		{"unknown key in acl", "acl:\n  alow: [10.0.0.0/8]", "Unknown key [acl.alow]"},
+		{"servers as strings and maps", "servers:\n  - a:8125\n  - address: b:8125\n    weight: 2\n    connections: 2", ""},
+		{"nil section", "stats:", "can't be empty"},
+		{"nil nested section", "graphite:\n  acl:", "can't be empty"},
+		{"zero duration", "timeout: 0", "Value of timeout must be positive"},
+		{"negative duration", "reconnect_interval: -1s", "Value of reconnect_interval must be positive"},
+		{"zero dns ttl", "source_dns_ttl: 0s", "Value of source_dns_ttl must be positive"},
+		{"zero stats interval", "stats:\n  enabled: true\n  interval: 0", "Stats interval must be positive"},
+		{"zero cache size in lines", "cache_size: 0", "Value of cache_size must be positive"},
+		{"zero cache size in bytes", "cache_size: 0MiB", "Value of cache_size must be positive"},
+		{"negative queue size", "backend_queue_size: -1", "Value of backend_queue_size must be positive"},
+		{"zero dns cache size", "source_dns_cache_size: 0", "Value of source_dns_cache_size must be positive"},
+		{"zero mirror cache size", "mirror:\n  enabled: true\n  cache_size: 0", "Mirror cache_size must be positive"},
+		{"negative log size", "log_max_size: -1", "can't be negative"},
+		{"zero cardinality window", "cardinality:\n  enabled: true\n  window: 0", "must be positive"},
+		{"zero cardinality total names", "cardinality:\n  enabled: true\n  max_total_names: 0", "max_total_names and window must be positive"},
+		{"servers file without servers", "servers: []\nservers_file: /etc/statsd-ha-proxy/servers.yml", ""},
+		{"no servers", "servers: []", "Bad servers: servers list is empty"},
+		{"zero weight in weighted mode", "mode: weighted\nservers:\n  - a:8125\n  - address: b:8125\n    weight: 0", "bad weight [0] for server [b:8125]"},
+		{"negative weight in weighted mode", "mode: weighted\nservers:\n  - address: a:8125\n    weight: -1", "bad weight [-1]"},
+		{"zero weight in priority mode", "mode: priority\nservers:\n  - address: a:8125\n    weight: 0", ""},
+		{"zero weight of graphite", "graphite:\n  enabled: true\n  mode: weighted\n  servers:\n    - address: a:2003\n      weight: 0", "Bad graphite servers: bad weight"},
+		{"bad server of servers file fallback", "servers: [{weight: 2}]\nservers_file: /etc/statsd-ha-proxy/servers.yml", "server address is empty"},
+	} {
+		path := writeConfig(t, test.config)
+		defer os.RemoveAll(filepath.Dir(path))
+		_, err := loadConfig(path, nil)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s: config is valid, expected error [%s]", test.name, test.err)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: error [%v], expected [%s]", test.name, err, test.err)
+		}
+	}
+}
+
+func TestCheckConfigExitCode(t *testing.T) {
+	for _, test := range []struct {
+		config string
+		code   int
+		output string
+	}{
+		{"listen: :8125", 0, "is valid"},
+		{"listen: :8125\ntimeout: 0", 1, "Value of timeout must be positive"},
+		{"listen: [", 1, "Can't parse config file"},
+	} {
+		path := writeConfig(t, test.config)
+		defer os.RemoveAll(filepath.Dir(path))
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(), mainArgsEnv+"=--check-config -c "+path)
+		output, err := cmd.CombinedOutput()
+		code := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.Sys().(interface{ ExitStatus() int }).ExitStatus()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if code != test.code || !strings.Contains(string(output), test.output) {
+			t.Errorf("Config [%s] exits with %d and [%s], expected %d and [%s]", test.config, code, strings.TrimSpace(string(output)), test.code, test.output)
+		}
+	}
+}
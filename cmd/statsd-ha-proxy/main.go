@@ -2,17 +2,21 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"regexp"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/AlexAkulov/statsd-ha-proxy/admin"
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
 	"github.com/AlexAkulov/statsd-ha-proxy/server"
+	"github.com/AlexAkulov/statsd-ha-proxy/tap"
 	"github.com/AlexAkulov/statsd-ha-proxy/upstreams"
 	"github.com/go-kit/kit/metrics/graphite"
-	"github.com/op/go-logging"
 	"github.com/spf13/pflag"
 )
 
@@ -21,19 +25,25 @@ var (
 	goVersion = "unknown"
 	buildDate = "unknown"
 
-	log *logging.Logger
+	log *logger.Logger
 )
 
 func main() {
 	versionFlag := pflag.BoolP("version", "v", false, "Print version and exit")
 	configPath := pflag.StringP("config", "c", "config.yml", "Path to config file")
 	helpFlag := pflag.BoolP("help", "h", false, "Print this message and exit")
-	printDefaultConfigFlag := pflag.Bool("print-default-config", false, "Print default config and exit")
+	printDefaultConfigFlag := pflag.Bool("print-default-config", false, "Print effective config and exit, config file is read only if --config is set")
+	checkConfigFlag := pflag.Bool("check-config", false, "Check config file and exit, exit code is 1 if config is invalid")
+	listenFlag := pflag.String("listen", "", "Override listen of config")
+	serversFlag := pflag.StringSlice("servers", nil, "Override servers of config, comma separated list")
+	setFlag := pflag.StringArray("set", nil, "Override any key of config like --set stats.enabled=true, can be repeated")
 
 	pflag.Parse()
 
 	if *helpFlag {
 		pflag.PrintDefaults()
+		fmt.Println("\nConfig is merged in order: defaults, config file, " + envPrefix + "* environment variables, --set, --listen and --servers.")
+		fmt.Println("Environment variable of key stats.enabled is " + envName("stats.enabled") + ".")
 		os.Exit(0)
 	}
 
@@ -44,105 +54,336 @@ func main() {
 		os.Exit(0)
 	}
 
+	overrides := *setFlag
+	if pflag.CommandLine.Changed("listen") {
+		overrides = append(overrides, "listen="+*listenFlag)
+	}
+	if pflag.CommandLine.Changed("servers") {
+		overrides = append(overrides, "servers="+strings.Join(*serversFlag, ","))
+	}
+
 	if *printDefaultConfigFlag {
-		printDefaultConfig()
+		// Package build prints defaults without config file
+		path := ""
+		if pflag.CommandLine.Changed("config") {
+			path = *configPath
+		}
+		config, err := loadConfig(path, overrides)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		printConfig(config)
 		os.Exit(0)
 	}
 
-	config, err := loadConfig(*configPath)
+	config, err := loadConfig(*configPath, overrides)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 
-	log, err = newLog(config.LogFile, config.LogLevel)
+	if *checkConfigFlag {
+		fmt.Printf("Config file [%s] is valid\n", *configPath)
+		os.Exit(0)
+	}
+
+	var logFile *logger.File
+	log, logFile, err = newLog(config)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-
-	var cache = make(chan []byte, config.CacheSize)
-
-	// Selfstate metrics
-	hostname, err := os.Hostname()
-	if err != nil {
-		hostname = "unknown"
-	} else {
-		hostname = strings.Split(hostname, ".")[0]
+	serverLog := config.componentLog(log, logServer)
+	upstreamsLog := config.componentLog(log, logUpstreams)
+	statsLog := config.componentLog(log, logStats)
+	for _, name := range config.unknownEnv {
+		log.Warning("Unknown environment variable is ignored", "name", name)
 	}
 
-	var selfStateTicker *time.Ticker
+	cache := config.CacheSize.newQueue()
 
-	selfState := graphite.New(fmt.Sprintf("%s.statsite_proxy.%s.", config.Stats.GraphitePrefix, hostname), nil)
+	// Selfstate metrics
+	selfStatePrefix := statsPrefix(config.Stats.Path, config.Stats.GraphitePrefix)
+	selfState := graphite.New(selfStatePrefix, nil)
+	var selfStatsReporter *selfStats
 	if config.Stats.Enabled {
-		selfStateTicker = time.NewTicker(60 * time.Second)
 		cacheMaxSize := selfState.NewGauge("cache.max_size")
+		cacheMaxLines := selfState.NewGauge("cache.max_lines")
 		cacheUsed := selfState.NewGauge("cache.used")
+		cacheLines := selfState.NewGauge("cache.lines")
+		selfStatsReporter = &selfStats{
+			Graphite: selfState,
+			Interval: time.Duration(config.Stats.Interval),
+			Protocol: config.Stats.Protocol,
+			Address:  config.Stats.GraphiteURI,
+			Queue:    cache,
+			Log:      statsLog,
+			BeforeFlush: func() {
+				// Sizes are in bytes, max values are 0 when cache isn't limited by them
+				used, lines := cache.Used(), cache.Len()
+				cacheMaxSize.Set(float64(cache.MaxBytes()))
+				cacheMaxLines.Set(float64(cache.MaxLines()))
+				cacheUsed.Set(float64(used))
+				cacheLines.Set(float64(lines))
+				statsLog.Debug("Cache usage", "used", used, "lines", lines, "max", config.CacheSize)
+			},
+		}
+	}
 
-		go func(c <-chan time.Time) {
-			for range c {
-				var err error
-				addr, err := net.ResolveTCPAddr("tcp", config.Stats.GraphiteURI)
-				if err != nil {
-					log.Errorf("Stats err: %v", err)
-					continue
-				}
-				conn, err := net.DialTCP("tcp", nil, addr)
-				if err != nil {
-					log.Errorf("Stats err: %v", err)
-					continue
-				}
-				cacheMaxSize.Set(float64(config.CacheSize))
-				cacheUsed.Set(float64(len(cache)))
-				log.Debugf("Cache used %d, max %d", len(cache), config.CacheSize)
-				if _, err := selfState.WriteTo(conn); err != nil {
-					log.Error("Stats during", "WriteTo", "err", err)
-				}
-				conn.Close()
-			}
-		}(selfStateTicker.C)
+	serversList := make([]string, len(config.Backends))
+	for i, b := range config.Backends {
+		serversList[i] = b.Server
+	}
+
+	var (
+		rejects    *server.RejectLog
+		trafficTap *tap.Tap
+	)
+	if config.Admin.Enabled {
+		rejects = server.NewRejectLog(config.Admin.RejectedLines)
+		trafficTap = &tap.Tap{}
+	}
+
+	var statsiteMirror *upstreams.Mirror
+	if config.Mirror.Enabled {
+		statsiteMirror = &upstreams.Mirror{
+			Server:            config.Mirror.Server,
+			SampleRate:        config.Mirror.SampleRate,
+			Queue:             config.Mirror.CacheSize.newQueue(),
+			ReconnectInterval: time.Duration(config.ReconnectInterval),
+			Timeout:           time.Duration(config.Timeout),
+			Stats:             selfState,
+			Log:               upstreamsLog,
+		}
+		if config.Mirror.Pattern != "" {
+			statsiteMirror.Pattern = regexp.MustCompile(config.Mirror.Pattern)
+		}
 	}
 
 	// Start Backends
 	statsiteBackends := upstreams.Upstream{
-		Log:                      log,
-		Stats:                    selfState,
-		Channel:                  cache,
-		BackendsList:             config.Backends,
-		BackendReconnectInterval: time.Millisecond * time.Duration(config.ReconnectInterval),
-		BackendTimeout:           time.Millisecond * time.Duration(config.Timeout),
-		SwitchLatency:            time.Millisecond * time.Duration(config.SwitchLatency),
+		Log:                         upstreamsLog,
+		Stats:                       selfState,
+		StatsPrefix:                 selfStatePrefix,
+		Queue:                       cache,
+		Mode:                        config.Mode,
+		Mirror:                      statsiteMirror,
+		Tap:                         trafficTap,
+		BackendsList:                config.Backends,
+		BackendsFile:                config.BackendsFile,
+		BackendsFileInterval:        time.Duration(config.BackendsFileCheckInterval),
+		BackendReconnectInterval:    time.Duration(config.ReconnectInterval),
+		BackendReconnectMaxInterval: time.Duration(config.ReconnectMaxInterval),
+		BackendTimeout:              time.Duration(config.Timeout),
+		DegradedLatency:             time.Duration(config.DegradedLatency),
+		DegradedQueue:               config.DegradedQueue,
+		BackendQueueSize:            config.BackendQueueSize,
+		SwitchLatency:               time.Duration(config.SwitchLatency),
+		DiscoveryInterval:           time.Duration(config.DiscoveryInterval),
 	}
 
 	statsiteBackends.Start()
 
+	sampling := make([]server.SamplingRule, len(config.Sampling))
+	for i, rule := range config.Sampling {
+		sampling[i] = server.SamplingRule{
+			Pattern: regexp.MustCompile(rule.Pattern),
+			Rate:    rule.Rate,
+			Types:   rule.Types,
+		}
+	}
+
+	var cardinalityLimiter *server.CardinalityLimiter
+	if config.Cardinality.Enabled {
+		cardinalityLimiter = &server.CardinalityLimiter{
+			PrefixDepth:   config.Cardinality.PrefixDepth,
+			MaxNames:      config.Cardinality.MaxNames,
+			MaxPrefixes:   config.Cardinality.MaxPrefixes,
+			MaxTotalNames: config.Cardinality.MaxTotalNames,
+			Window:        time.Duration(config.Cardinality.Window),
+			Action:        config.Cardinality.Action,
+		}
+	}
+
 	statsiteProxyServer := server.Server{
-		Log:           log,
-		Stats:         selfState,
-		Channel:       cache,
-		ConfigListen:  config.Listen,
-		ConfigServers: config.Backends,
+		Log:                  serverLog,
+		Stats:                selfState,
+		Queue:                cache,
+		ConfigListen:         config.Listen,
+		ConfigServers:        serversList,
+		ProxyProtocol:        config.ProxyProtocol,
+		ProxyProtocolTrusted: mustParseNetworks(config.ProxyTrusted),
+		SourceTag:            config.SourceTag,
+		SourcePrefix:         config.SourcePrefix,
+		Resolver:             config.newResolver(config.SourceResolve),
+		ACL:                  mustBuildACL(config.ACL),
+		Sampling:             sampling,
+		Allow:                compilePatterns(config.Filter.Allow),
+		Deny:                 compilePatterns(config.Filter.Deny),
+		Cardinality:          cardinalityLimiter,
+		InvalidLinesLogRate:  config.InvalidLinesLogRate,
+		Rejects:              rejects,
+		Tap:                  trafficTap,
 	}
 
 	if err := statsiteProxyServer.Start(); err != nil {
 		statsiteBackends.Stop()
-		log.Fatal(err)
+		log.Error("Start server fail", "listen", config.Listen, "error", err)
+		os.Exit(1)
 	}
 
-	signalChannel := make(chan os.Signal)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
-	log.Info(<-signalChannel)
+	// Carbon relay
+	var (
+		carbonBackends    *upstreams.Upstream
+		carbonProxyServer *server.Server
+	)
+	if config.Graphite.Enabled {
+		carbonCache := config.Graphite.CacheSize.newQueue()
+		carbonBackends = &upstreams.Upstream{
+			Log:                         upstreamsLog.With("upstream", "graphite"),
+			Stats:                       selfState,
+			StatsPrefix:                 selfStatePrefix,
+			StatsName:                   "upstreams.graphite",
+			Queue:                       carbonCache,
+			Tap:                         trafficTap,
+			Mode:                        config.Graphite.Mode,
+			BackendsList:                config.Graphite.Backends,
+			BackendReconnectInterval:    time.Duration(config.ReconnectInterval),
+			BackendReconnectMaxInterval: time.Duration(config.ReconnectMaxInterval),
+			BackendTimeout:              time.Duration(config.Timeout),
+			DegradedLatency:             time.Duration(config.DegradedLatency),
+			DegradedQueue:               config.DegradedQueue,
+			BackendQueueSize:            config.Graphite.BackendQueueSize,
+			SwitchLatency:               time.Duration(config.SwitchLatency),
+			DiscoveryInterval:           time.Duration(config.DiscoveryInterval),
+		}
+		carbonBackends.Start()
+
+		carbonProxyServer = &server.Server{
+			Log:                  serverLog.With("listener", "graphite"),
+			Stats:                selfState,
+			Queue:                carbonCache,
+			ConfigListen:         config.Graphite.Listen,
+			Protocol:             server.ProtocolGraphite,
+			ProxyProtocol:        config.Graphite.ProxyProtocol,
+			ProxyProtocolTrusted: mustParseNetworks(config.Graphite.ProxyTrusted),
+			SourceTag:            config.Graphite.SourceTag,
+			SourcePrefix:         config.Graphite.SourcePrefix,
+			Resolver:             config.newResolver(config.Graphite.SourceResolve),
+			ACL:                  mustBuildACL(config.Graphite.ACL),
+			InvalidLinesLogRate:  config.InvalidLinesLogRate,
+			Rejects:              rejects,
+			Tap:                  trafficTap,
+		}
+		if err := carbonProxyServer.Start(); err != nil {
+			statsiteProxyServer.Stop()
+			statsiteBackends.Stop()
+			carbonBackends.Stop()
+			log.Error("Start graphite server fail", "listen", config.Graphite.Listen, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Metrics of backends are reported by upstreams, so the reporter is started when they are
+	if selfStatsReporter != nil {
+		selfStatsReporter.Sources = []io.WriterTo{&statsiteBackends}
+		if carbonBackends != nil {
+			selfStatsReporter.Sources = append(selfStatsReporter.Sources, carbonBackends)
+		}
+		selfStatsReporter.Start()
+	}
+
+	// Admin endpoint isn't required for proxying, so the proxy works without it
+	var adminServer *admin.Server
+	if config.Admin.Enabled {
+		adminServer = &admin.Server{
+			Listen:  config.Admin.Listen,
+			Log:     config.componentLog(log, logAdmin),
+			Rejects: rejects,
+			Tap:     trafficTap,
+			Upstreams: map[string]*upstreams.Upstream{
+				"statsd": &statsiteBackends,
+			},
+		}
+		if carbonBackends != nil {
+			adminServer.Upstreams["graphite"] = carbonBackends
+		}
+		if err := adminServer.Start(); err != nil {
+			log.Error("Start admin server fail", "listen", config.Admin.Listen, "error", err)
+			adminServer = nil
+		}
+	}
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	for sig := range signalChannel {
+		// SIGUSR1 is sent by logrotate after the log file is moved
+		if sig == syscall.SIGUSR1 {
+			if logFile == nil {
+				continue
+			}
+			if err := logFile.Reopen(); err != nil {
+				fmt.Fprintf(os.Stderr, "Can't reopen log file %s: %v\n", config.LogFile, err)
+				continue
+			}
+			log.Info("Log file is reopened", "file", config.LogFile)
+			continue
+		}
+		log.Info("Signal is received, stopping", "signal", sig)
+		break
+	}
+
+	if adminServer != nil {
+		if err := adminServer.Stop(); err != nil {
+			log.Error("Stop fail", "error", err)
+		}
+	}
 
 	if err := statsiteProxyServer.Stop(); err != nil {
-		log.Error(err)
+		log.Error("Stop fail", "error", err)
 	}
 
 	if err := statsiteBackends.Stop(); err != nil {
-		log.Error(err)
+		log.Error("Stop fail", "error", err)
+	}
+
+	if config.Graphite.Enabled {
+		if err := carbonProxyServer.Stop(); err != nil {
+			log.Error("Stop fail", "error", err)
+		}
+		if err := carbonBackends.Stop(); err != nil {
+			log.Error("Stop fail", "error", err)
+		}
 	}
 
-	if selfStateTicker != nil {
-		selfStateTicker.Stop()
+	if selfStatsReporter != nil {
+		selfStatsReporter.Stop()
 	}
 
 }
+
+// mustBuildACL returns ACL of listener, config is already validated
+func mustBuildACL(a *acl) *server.ACL {
+	result, err := a.build()
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+func mustParseNetworks(networks []string) []*net.IPNet {
+	result, err := parseNetworks(networks)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	var result []*regexp.Regexp
+	for _, pattern := range patterns {
+		result = append(result, regexp.MustCompile(pattern))
+	}
+	return result
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Every key of config can be set by environment variable like STATSD_HA_PROXY_STATS_ENABLED for stats.enabled
+const envPrefix = "STATSD_HA_PROXY_"
+
+var yamlUnmarshaler = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+func yamlName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// isSection is true for nested structs of config, values with custom unmarshaling like cache_size aren't sections
+func isSection(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && !reflect.PtrTo(t).Implements(yamlUnmarshaler)
+}
+
+// configKeys returns dotted paths of all values in config
+func configKeys(t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		name := yamlName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		if isSection(t.Field(i).Type) {
+			keys = append(keys, configKeys(t.Field(i).Type, prefix+name+".")...)
+			continue
+		}
+		keys = append(keys, prefix+name)
+	}
+	return keys
+}
+
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// set overrides value of config by dotted key like stats.enabled.
+// Value is parsed as YAML. Lists are comma separated values, YAML flow list is used only when the whole
+// value is a list like [a, b], so addresses like [::1]:8125 are items.
+func (c *config) set(key, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range strings.Split(key, ".") {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		if !isSection(v.Type()) {
+			return fmt.Errorf("Unknown key [%s]", key)
+		}
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			if yamlName(v.Type().Field(i)) == name {
+				v = v.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown key [%s]", key)
+		}
+	}
+	if isSection(v.Type()) {
+		return fmt.Errorf("Key [%s] is a section, set its keys instead", key)
+	}
+	if v.Kind() == reflect.String {
+		v.SetString(value)
+		return nil
+	}
+	data := []byte(value)
+	if v.Kind() == reflect.Slice && !isFlowList(value) {
+		items := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		data, _ = yaml.Marshal(items)
+	}
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("Bad value [%s] of [%s] [%s]", value, key, err)
+	}
+	if err := checkUnknownKeys(raw, v.Type(), key+"."); err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, v.Addr().Interface()); err != nil {
+		return fmt.Errorf("Bad value [%s] of [%s] [%s]", value, key, err)
+	}
+	return nil
+}
+
+// isFlowList is true when value is a YAML list like [a, b] as a whole
+func isFlowList(value string) bool {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return false
+	}
+	var list []interface{}
+	return yaml.Unmarshal([]byte(value), &list) == nil
+}
+
+// applyEnv overrides config by STATSD_HA_PROXY_* variables from environ. Unknown variables are
+// remembered and ignored, Kubernetes sets variables like STATSD_HA_PROXY_PORT for a service with this name.
+func (c *config) applyEnv(environ []string) error {
+	keys := make(map[string]string)
+	for _, key := range configKeys(reflect.TypeOf(c), "") {
+		keys[envName(key)] = key
+	}
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		key, ok := keys[parts[0]]
+		if !ok {
+			c.unknownEnv = append(c.unknownEnv, parts[0])
+			continue
+		}
+		if err := c.set(key, parts[1]); err != nil {
+			return fmt.Errorf("Bad environment variable [%s] [%s]", parts[0], err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/upstreams"
+	"gopkg.in/yaml.v2"
+)
+
+func TestEnvName(t *testing.T) {
+	for key, expected := range map[string]string{
+		"listen":             "STATSD_HA_PROXY_LISTEN",
+		"stats.enabled":      "STATSD_HA_PROXY_STATS_ENABLED",
+		"graphite.acl.allow": "STATSD_HA_PROXY_GRAPHITE_ACL_ALLOW",
+	} {
+		if name := envName(key); name != expected {
+			t.Errorf("Variable of [%s] is %s, expected %s", key, name, expected)
+		}
+	}
+
+	keys := make(map[string]bool)
+	for _, key := range configKeys(reflect.TypeOf(&config{}), "") {
+		keys[key] = true
+	}
+	// Values with custom unmarshaling are keys, not sections
+	for _, key := range []string{"listen", "servers", "cache_size", "timeout", "stats.enabled", "mirror.cache_size", "graphite.servers", "graphite.acl.prefixes"} {
+		if !keys[key] {
+			t.Errorf("Key [%s] is missing", key)
+		}
+	}
+	for _, key := range []string{"stats", "graphite.acl", "cache_size.lines", "cache_size.bytes"} {
+		if keys[key] {
+			t.Errorf("Section [%s] is a key", key)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	c := getDefaultConfig()
+	for _, test := range []struct {
+		key, value string
+		check      func() bool
+	}{
+		{"listen", ":9125", func() bool { return c.Listen == ":9125" }},
+		{"timeout", "5s", func() bool { return c.Timeout == duration(5*time.Second) }},
+		{"timeout", "500", func() bool { return c.Timeout == duration(500*time.Millisecond) }},
+		{"cache_size", "512MiB", func() bool { return c.CacheSize == cacheSize{Bytes: 512 << 20} }},
+		{"cache_size", "1000000", func() bool { return c.CacheSize == cacheSize{Lines: 1000000} }},
+		{"stats.enabled", "true", func() bool { return c.Stats.Enabled }},
+		{"servers", "a:8125, b:8125", func() bool {
+			return reflect.DeepEqual(c.Backends, []upstreams.BackendConfig{{Server: "a:8125", Weight: 1}, {Server: "b:8125", Weight: 1}})
+		}},
+		{"servers", `[{address: "a:8125", weight: 3}, "b:8125"]`, func() bool {
+			return reflect.DeepEqual(c.Backends, []upstreams.BackendConfig{{Server: "a:8125", Weight: 3}, {Server: "b:8125", Weight: 1}})
+		}},
+		// Brackets of IPv6 address aren't a YAML list
+		{"servers", "[::1]:8125", func() bool {
+			return reflect.DeepEqual(c.Backends, []upstreams.BackendConfig{{Server: "[::1]:8125", Weight: 1}})
+		}},
+		{"servers", "[::1]:8125, [fe80::1]:8125", func() bool {
+			return reflect.DeepEqual(c.Backends, []upstreams.BackendConfig{{Server: "[::1]:8125", Weight: 1}, {Server: "[fe80::1]:8125", Weight: 1}})
+		}},
+		{"servers", `["[::1]:8125"]`, func() bool {
+			return reflect.DeepEqual(c.Backends, []upstreams.BackendConfig{{Server: "[::1]:8125", Weight: 1}})
+		}},
+		{"filter.deny", "^a\\.,^b\\.", func() bool { return reflect.DeepEqual(c.Filter.Deny, []string{"^a\\.", "^b\\."}) }},
+		{"filter.deny", "", func() bool { return len(c.Filter.Deny) == 0 }},
+		{"acl.prefixes", "{10.0.0.0/8: [team_a.*]}", func() bool {
+			return reflect.DeepEqual(c.ACL.Prefixes, map[string][]string{"10.0.0.0/8": {"team_a.*"}})
+		}},
+	} {
+		if err := c.set(test.key, test.value); err != nil {
+			t.Errorf("Can't set [%s] to [%s]: %v", test.key, test.value, err)
+		} else if !test.check() {
+			t.Errorf("Value [%s] of [%s] isn't set", test.value, test.key)
+		}
+	}
+
+	for _, test := range []struct{ key, value, err string }{
+		{"listen2", "x", "Unknown key [listen2]"},
+		{"stats.enable", "true", "Unknown key [stats.enable]"},
+		{"listen.port", "1", "Unknown key [listen.port]"},
+		{"stats", "{enabled: true}", "is a section"},
+		{"stats.enabled", "maybe", "Bad value"},
+		{"servers", `[{address: "a:8125", wieght: 3}]`, "Unknown key [servers.0.wieght]"},
+		{"timeout", "10x", "Bad value"},
+	} {
+		err := c.set(test.key, test.value)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Set of [%s] to [%s] returns [%v], expected [%s]", test.key, test.value, err, test.err)
+		}
+	}
+}
+
+func TestSetNilSection(t *testing.T) {
+	c := config{}
+	if err := c.set("graphite.acl.allow", "10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Graphite == nil || c.Graphite.ACL == nil || !reflect.DeepEqual(c.Graphite.ACL.Allow, []string{"10.0.0.0/8"}) {
+		t.Errorf("Nil sections aren't allocated: %+v", c.Graphite)
+	}
+	if c.Stats != nil || c.ACL != nil {
+		t.Errorf("Other sections are allocated")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	c := getDefaultConfig()
+	err := c.applyEnv([]string{
+		"HOME=/root",
+		"STATSD_HA_PROXY_LISTEN=:9125",
+		"STATSD_HA_PROXY_SERVERS=a:8125,b:8125",
+		"STATSD_HA_PROXY_STATS_ENABLED=true",
+		"STATSD_HA_PROXY_GRAPHITE_ACL_DENY=10.0.0.1",
+		// Value may contain '='
+		"STATSD_HA_PROXY_MIRROR_PATTERN=^a=b",
+		// Service variables of Kubernetes aren't keys of config
+		"STATSD_HA_PROXY_PORT=tcp://10.0.0.1:8125",
+		"STATSD_HA_PROXY_SERVICE_HOST=10.0.0.1",
+		"STATSD_HA_PROXY_STATS=1",
+		"STATSD_HA_PROXY_CACHE_SIZE_LINES=1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != ":9125" || len(c.Backends) != 2 || !c.Stats.Enabled || len(c.Graphite.ACL.Deny) != 1 || c.Mirror.Pattern != "^a=b" {
+		t.Errorf("Variables aren't applied: %+v", c)
+	}
+	expected := []string{"STATSD_HA_PROXY_PORT", "STATSD_HA_PROXY_SERVICE_HOST", "STATSD_HA_PROXY_STATS", "STATSD_HA_PROXY_CACHE_SIZE_LINES"}
+	if !reflect.DeepEqual(c.unknownEnv, expected) {
+		t.Errorf("Unknown variables are %v, expected %v", c.unknownEnv, expected)
+	}
+
+	c = getDefaultConfig()
+	if err := c.applyEnv([]string{"STATSD_HA_PROXY_TIMEOUT=10x"}); err == nil || !strings.Contains(err.Error(), "Bad environment variable [STATSD_HA_PROXY_TIMEOUT]") {
+		t.Errorf("Bad value of known variable returns [%v]", err)
+	}
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	path := writeConfig(t, "listen: :1\ntimeout: 1s\nbackend_queue_size: 10\nmode: weighted\nservers: [\"file:8125\"]\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(),
+		mainArgsEnv+"=--print-default-config -c "+path+" --set listen=:3 --set timeout=3s --listen :4 --servers a:8125,b:8125",
+		"STATSD_HA_PROXY_LISTEN=:2",
+		"STATSD_HA_PROXY_TIMEOUT=2s",
+		"STATSD_HA_PROXY_BACKEND_QUEUE_SIZE=20",
+		"STATSD_HA_PROXY_SERVERS=env:8125",
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	var c config
+	if err := yaml.Unmarshal(output, &c); err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	// File < environment < --set < --listen and --servers
+	if c.Mode != "weighted" {
+		t.Errorf("Mode from file is %s", c.Mode)
+	}
+	if c.BackendQueueSize != 20 {
+		t.Errorf("Backend queue size from environment is %d", c.BackendQueueSize)
+	}
+	if c.Timeout != duration(3*time.Second) {
+		t.Errorf("Timeout from --set is %s", time.Duration(c.Timeout))
+	}
+	if c.Listen != ":4" {
+		t.Errorf("Listen from --listen is %s", c.Listen)
+	}
+	if !reflect.DeepEqual(c.Backends, []upstreams.BackendConfig{{Server: "a:8125", Weight: 1}, {Server: "b:8125", Weight: 1}}) {
+		t.Errorf("Servers from --servers are %v", c.Backends)
+	}
+}
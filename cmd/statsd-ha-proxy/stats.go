@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+// Transports of self stats
+const (
+	statsTCP = "tcp"
+	statsUDP = "udp"
+	// statsUpstream sends self stats as statsd gauges through the proxy's own upstreams
+	statsUpstream = "upstream"
+)
+
+// maxStatsPacket is max size of UDP packet with self stats
+const maxStatsPacket = 1400
+
+// maxStatsBacklog is max size of self stats which wait for the next flush because they can't be sent.
+// The oldest lines are dropped above it.
+const maxStatsBacklog = 1 << 20
+
+// selfStats flushes metrics of the proxy every Interval
+type selfStats struct {
+	Graphite *graphite.Graphite
+	// Metrics which are written after Graphite, e.g. of backends which can be removed
+	Sources  []io.WriterTo
+	Interval time.Duration
+	Protocol string
+	Address  string
+	Queue    *queue.Queue
+	Log      *logger.Logger
+	// BeforeFlush updates gauges which aren't updated by components themselves
+	BeforeFlush func()
+
+	// Lines which weren't sent, counters are reset when they are written, so lines are sent with the next flush
+	backlog []byte
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// statsPrefix expands {prefix}, {host} and {fqdn} in template. {host} is short hostname,
+// dots in {fqdn} are replaced with '_' so it is a single node of metric path.
+func statsPrefix(template, prefix string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	result := strings.NewReplacer(
+		"{prefix}", prefix,
+		"{host}", strings.Split(hostname, ".")[0],
+		"{fqdn}", strings.Replace(hostname, ".", "_", -1),
+	).Replace(template)
+	if !strings.HasSuffix(result, ".") {
+		result += "."
+	}
+	return result
+}
+
+func (s *selfStats) Start() {
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.flush()
+			}
+		}
+	}()
+}
+
+func (s *selfStats) Stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+func (s *selfStats) flush() {
+	if s.BeforeFlush != nil {
+		s.BeforeFlush()
+	}
+	buf := bytes.NewBuffer(s.backlog)
+	s.backlog = nil
+	s.Graphite.WriteTo(buf)
+	for _, source := range s.Sources {
+		source.WriteTo(buf)
+	}
+	var (
+		unsent []byte
+		err    error
+	)
+	switch s.Protocol {
+	case statsUDP:
+		unsent, err = s.sendUDP(buf.Bytes())
+	case statsUpstream:
+		s.sendUpstream(buf.Bytes())
+	default:
+		unsent, err = s.sendTCP(buf.Bytes())
+	}
+	if err != nil {
+		s.Log.Error("Send stats fail", "address", s.Address, "protocol", s.Protocol, "error", err)
+		s.keep(unsent)
+	}
+}
+
+// keep puts unsent lines to backlog, the oldest lines are dropped if there are more than maxStatsBacklog bytes
+func (s *selfStats) keep(data []byte) {
+	if len(data) > maxStatsBacklog {
+		cut := len(data) - maxStatsBacklog
+		data = data[cut+bytes.IndexByte(data[cut:], '\n')+1:]
+		s.Log.Warning("Stats backlog is full, the oldest stats are dropped", "bytes", cut)
+	}
+	s.backlog = append([]byte(nil), data...)
+}
+
+// sendTCP returns lines which are not sent on error, line which was written partially is sent again
+func (s *selfStats) sendTCP(data []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", s.Address, s.Interval)
+	if err != nil {
+		return data, err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(s.Interval))
+	n, err := conn.Write(data)
+	if err != nil {
+		return data[bytes.LastIndexByte(data[:n], '\n')+1:], err
+	}
+	return nil, nil
+}
+
+// sendUDP sends whole lines in packets not bigger than maxStatsPacket, returns lines which are not sent on error
+func (s *selfStats) sendUDP(data []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", s.Address)
+	if err != nil {
+		return data, err
+	}
+	defer conn.Close()
+	for len(data) > 0 {
+		end := len(data)
+		if end > maxStatsPacket {
+			end = bytes.LastIndexByte(data[:maxStatsPacket], '\n') + 1
+			if end == 0 {
+				end = bytes.IndexByte(data, '\n') + 1
+			}
+			if end == 0 {
+				end = len(data)
+			}
+		}
+		if _, err := conn.Write(data[:end]); err != nil {
+			return data, err
+		}
+		data = data[end:]
+	}
+	return nil, nil
+}
+
+// statsdNameReplacer replaces symbols which can't be used in statsd metric name
+var statsdNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_")
+
+// sendUpstream converts "path value timestamp" lines to statsd gauges "path:value|g".
+// Values are the same as in graphite: counters are counts for the last interval.
+// Lines are dropped if cache is full, self stats must not block the traffic.
+func (s *selfStats) sendUpstream(data []byte) {
+	dropped := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		if !s.Queue.TryPut([]byte(fmt.Sprintf("%s:%s|g", statsdNameReplacer.Replace(fields[0]), fields[1]))) {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		s.Log.Warning("Cache is full, self stats are dropped", "dropped", dropped)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+// receiveStats accepts one connection of selfStats and returns its lines
+func receiveStats(t *testing.T, l net.Listener) []string {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	defer conn.Close()
+	var lines []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestStatsEndpointDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	stats := graphite.New("proxy.", nil)
+	counter := stats.NewCounter("lines")
+	s := &selfStats{Graphite: stats, Interval: time.Second, Protocol: statsTCP, Address: addr, Log: logger.Nop()}
+	// Endpoint is down for one interval, its counter values are sent with the next flush
+	counter.Add(5)
+	s.flush()
+	if l, err = net.Listen("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	counter.Add(2)
+	received := make(chan []string, 1)
+	go func() { received <- receiveStats(t, l) }()
+	s.flush()
+
+	var values []string
+	for _, line := range <-received {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "proxy.lines" {
+			values = append(values, fields[1])
+		}
+	}
+	if strings.Join(values, " ") != "5.000000 2.000000" {
+		t.Errorf("Counter values are %v, expected 5 and 2", values)
+	}
+	if len(s.backlog) != 0 {
+		t.Errorf("Backlog isn't empty after send: %s", s.backlog)
+	}
+}
+
+func TestStatsBacklogLimit(t *testing.T) {
+	s := &selfStats{Log: logger.Nop()}
+	line := []byte(strings.Repeat("a", 99) + "\n")
+	data := bytes.Repeat(line, maxStatsBacklog/len(line)+10)
+	data = append([]byte("first 1 1\n"), data...)
+	s.keep(data)
+	// The oldest lines are dropped as a whole
+	if len(s.backlog) > maxStatsBacklog || !bytes.HasPrefix(s.backlog, line) || !bytes.HasSuffix(s.backlog, line) {
+		t.Errorf("Backlog has %d bytes, starts with [%.10s]", len(s.backlog), s.backlog)
+	}
+}
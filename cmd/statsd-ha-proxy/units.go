@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+)
+
+// duration is written as integer of milliseconds or as string like 10s or 500ms
+type duration time.Duration
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Numbers are unmarshaled as text too, so fractions like 1.5 aren't truncated to milliseconds silently
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Bad duration [%s], expected milliseconds or value like 10s or 500ms", s)
+	}
+	return v, nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	value  int64
+}{
+	// Longer suffixes go first
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"B", 1},
+}
+
+func parseByteSize(s string) (int64, error) {
+	number := strings.TrimSpace(s)
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(number, u.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, u.suffix))
+			unit = u.value
+			break
+		}
+	}
+	v, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Bad size [%s], expected bytes or value like 512MiB", s)
+	}
+	return v * unit, nil
+}
+
+func formatByteSize(v int64) string {
+	for _, u := range []struct {
+		suffix string
+		value  int64
+	}{{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}} {
+		if v != 0 && v%u.value == 0 {
+			return fmt.Sprintf("%d%s", v/u.value, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", v)
+}
+
+// byteSize is written as integer of bytes or as string like 100MiB
+type byteSize int64
+
+func (b *byteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(v)
+	return nil
+}
+
+func (b byteSize) MarshalYAML() (interface{}, error) {
+	if b == 0 {
+		return 0, nil
+	}
+	return formatByteSize(int64(b)), nil
+}
+
+// cacheSize is count of lines when it is written as number, quoted or not, and memory limit when it has unit like 512MiB or 1000B
+type cacheSize struct {
+	Lines int64
+	Bytes int64
+}
+
+func (c *cacheSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	switch v := raw.(type) {
+	case int:
+		*c = cacheSize{Lines: int64(v)}
+		return nil
+	case string:
+		// Environment and --set values are strings, so a bare number is lines there too
+		if lines, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			*c = cacheSize{Lines: lines}
+			return nil
+		}
+		size, err := parseByteSize(v)
+		if err != nil {
+			return err
+		}
+		*c = cacheSize{Bytes: size}
+		return nil
+	}
+	return fmt.Errorf("Bad cache size [%v], expected lines or value like 512MiB", raw)
+}
+
+func (c cacheSize) MarshalYAML() (interface{}, error) {
+	if c.Bytes > 0 {
+		return formatByteSize(c.Bytes), nil
+	}
+	return c.Lines, nil
+}
+
+// newQueue returns memory queue limited by lines or by bytes
+func (c cacheSize) newQueue() *queue.Queue {
+	return queue.New(c.Bytes, c.Lines)
+}
+
+// limit returns limit of queue in bytes or in lines, whichever is set
+func (c cacheSize) limit() int64 {
+	if c.Bytes > 0 {
+		return c.Bytes
+	}
+	return c.Lines
+}
+
+func (c cacheSize) String() string {
+	if c.Bytes > 0 {
+		return formatByteSize(c.Bytes)
+	}
+	return strconv.FormatInt(c.Lines, 10)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"100":    100,
+		"100B":   100,
+		"1KiB":   1 << 10,
+		"1K":     1 << 10,
+		"1KB":    1000,
+		"512MiB": 512 << 20,
+		"10 MB":  10 * 1000 * 1000,
+		"2G":     2 << 30,
+		" 3GiB ": 3 << 30,
+		"0":      0,
+	} {
+		if v, err := parseByteSize(s); err != nil || v != expected {
+			t.Errorf("Size [%s] is parsed as %d, %v, expected %d", s, v, err, expected)
+		}
+	}
+	for _, s := range []string{"", "MiB", "1TB", "1XB", "1.5GiB", "1 KiBs", "ten"} {
+		if v, err := parseByteSize(s); err == nil {
+			t.Errorf("Bad size [%s] is parsed as %d", s, v)
+		}
+	}
+}
+
+// units is a part of config with every unit type
+type units struct {
+	CacheSize  cacheSize `yaml:"cache_size"`
+	LogMaxSize byteSize  `yaml:"log_max_size"`
+	Timeout    duration  `yaml:"timeout"`
+}
+
+func TestUnmarshalUnits(t *testing.T) {
+	for _, test := range []struct {
+		yaml     string
+		expected units
+	}{
+		// Number is count of lines, quoted or not, bytes need unit
+		{"cache_size: 1000", units{CacheSize: cacheSize{Lines: 1000}}},
+		{`cache_size: "1000"`, units{CacheSize: cacheSize{Lines: 1000}}},
+		{"cache_size: 1000B", units{CacheSize: cacheSize{Bytes: 1000}}},
+		{"cache_size: 512MiB", units{CacheSize: cacheSize{Bytes: 512 << 20}}},
+		// Integer is bytes
+		{"log_max_size: 100", units{LogMaxSize: 100}},
+		{`log_max_size: "100"`, units{LogMaxSize: 100}},
+		{"log_max_size: 100MiB", units{LogMaxSize: 100 << 20}},
+		// Integer is milliseconds
+		{"timeout: 500", units{Timeout: duration(500 * time.Millisecond)}},
+		{`timeout: "500"`, units{Timeout: duration(500 * time.Millisecond)}},
+		{"timeout: 1m30s", units{Timeout: duration(90 * time.Second)}},
+	} {
+		var u units
+		if err := yaml.Unmarshal([]byte(test.yaml), &u); err != nil {
+			t.Errorf("Can't unmarshal [%s]: %v", test.yaml, err)
+			continue
+		}
+		if u != test.expected {
+			t.Errorf("[%s] is unmarshaled as %+v, expected %+v", test.yaml, u, test.expected)
+		}
+	}
+	for _, s := range []string{"cache_size: 10XB", "cache_size: 1.5GiB", "log_max_size: 1TB", "log_max_size: [1]", "cache_size: 1.5", "cache_size: [1]", "timeout: 10x", "timeout: ten", "timeout: 1.5", "timeout: [1]"} {
+		var u units
+		if err := yaml.Unmarshal([]byte(s), &u); err == nil {
+			t.Errorf("Bad value [%s] is unmarshaled as %+v", s, u)
+		}
+	}
+}
+
+func TestMarshalUnits(t *testing.T) {
+	for _, test := range []struct {
+		value units
+		yaml  string
+	}{
+		{units{}, "cache_size: 0\nlog_max_size: 0\ntimeout: 0s\n"},
+		{units{CacheSize: cacheSize{Lines: 1000}, LogMaxSize: 100, Timeout: duration(500 * time.Millisecond)}, "cache_size: 1000\nlog_max_size: 100B\ntimeout: 500ms\n"},
+		{units{CacheSize: cacheSize{Bytes: 1000}, LogMaxSize: 1 << 30, Timeout: duration(90 * time.Second)}, "cache_size: 1000B\nlog_max_size: 1GiB\ntimeout: 1m30s\n"},
+		{units{CacheSize: cacheSize{Bytes: 512 << 20}, LogMaxSize: 3072, Timeout: duration(time.Hour)}, "cache_size: 512MiB\nlog_max_size: 3KiB\ntimeout: 1h0m0s\n"},
+	} {
+		data, err := yaml.Marshal(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.yaml {
+			t.Errorf("%+v is marshaled as [%s], expected [%s]", test.value, data, test.yaml)
+		}
+		// Printed config is read back the same
+		var u units
+		if err := yaml.Unmarshal(data, &u); err != nil {
+			t.Errorf("Can't unmarshal [%s]: %v", data, err)
+			continue
+		}
+		if u != test.value {
+			t.Errorf("[%s] is unmarshaled as %+v, expected %+v", data, u, test.value)
+		}
+	}
+}
+
+func TestDefaultConfigRoundTrip(t *testing.T) {
+	defaults := getDefaultConfig()
+	data, err := yaml.Marshal(&defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Package config is printed defaults
+	path := writeConfig(t, string(data))
+	defer os.RemoveAll(filepath.Dir(path))
+	loaded, err := loadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Empty lists are read as nil, so printed configs are compared
+	printed, err := yaml.Marshal(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(printed) != string(data) {
+		t.Errorf("Printed defaults are read as\n%s\nexpected\n%s", printed, data)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/AlexAkulov/statsd-ha-proxy/server"
+	"github.com/AlexAkulov/statsd-ha-proxy/upstreams"
+)
+
+// checkUnknownKeys returns error for the first key of decoded YAML node which has no field in type t
+func checkUnknownKeys(node interface{}, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		// Types with custom unmarshaling like server address may be written as a scalar
+		m, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		for key, value := range m {
+			name := fmt.Sprint(key)
+			fieldType, ok := fields[name]
+			if !ok {
+				return fmt.Errorf("Unknown key [%s]", path+name)
+			}
+			if err := checkUnknownKeys(value, fieldType, path+name+"."); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		list, ok := node.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, value := range list {
+			if err := checkUnknownKeys(value, t.Elem(), fmt.Sprintf("%s%d.", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		m, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		for key, value := range m {
+			if err := checkUnknownKeys(value, t.Elem(), fmt.Sprintf("%s%v.", path, key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSourceTag returns error if name can't be used as tag of statsd and graphite lines
+func checkSourceTag(name string) error {
+	if strings.ContainsAny(name, ":|,#;= \t") {
+		return fmt.Errorf("Bad source_tag [%s], it can't contain separators of tags", name)
+	}
+	return nil
+}
+
+func checkMode(mode string) error {
+	if mode != upstreams.ModePriority && mode != upstreams.ModeWeighted {
+		return fmt.Errorf("Unknown mode [%s], expected %s or %s", mode, upstreams.ModePriority, upstreams.ModeWeighted)
+	}
+	return nil
+}
+
+// validate checks values of config, names of keys are used in messages
+func (c *config) validate() error {
+	if c.Filter == nil || c.ACL == nil || c.Cardinality == nil || c.Mirror == nil || c.Graphite == nil || c.Graphite.ACL == nil || c.Stats == nil || c.Admin == nil {
+		return fmt.Errorf("Sections filter, acl, cardinality, mirror, graphite, graphite.acl, stats and admin can't be empty")
+	}
+	if c.Listen == "" {
+		return fmt.Errorf("Listen is empty")
+	}
+	if err := checkMode(c.Mode); err != nil {
+		return err
+	}
+	if err := checkSourceTag(c.SourceTag); err != nil {
+		return err
+	}
+	if _, err := c.ACL.build(); err != nil {
+		return fmt.Errorf("Bad acl: %v", err)
+	}
+	if _, err := parseNetworks(c.ProxyTrusted); err != nil {
+		return fmt.Errorf("Bad proxy_protocol_trusted: %v", err)
+	}
+	// Servers from config are only a fallback when servers file is set
+	if c.BackendsFile == "" || len(c.Backends) > 0 {
+		if err := upstreams.CheckBackendsList(c.Backends, c.Mode); err != nil {
+			return fmt.Errorf("Bad servers: %v", err)
+		}
+	}
+	durations := []struct {
+		name  string
+		value duration
+	}{
+		{"timeout", c.Timeout},
+		{"reconnect_interval", c.ReconnectInterval},
+		{"reconnect_max_interval", c.ReconnectMaxInterval},
+		{"switch_upstream_latency", c.SwitchLatency},
+		{"discovery_interval", c.DiscoveryInterval},
+		{"servers_file_check_interval", c.BackendsFileCheckInterval},
+		{"source_dns_ttl", c.SourceDNSTTL},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			return fmt.Errorf("Value of %s must be positive, got %s", d.name, time.Duration(d.value))
+		}
+	}
+	if c.ReconnectMaxInterval < c.ReconnectInterval {
+		return fmt.Errorf("Value of reconnect_max_interval can't be less than reconnect_interval")
+	}
+	if c.DegradedLatency < 0 {
+		return fmt.Errorf("Value of degraded_latency can't be negative")
+	}
+	if c.DegradedQueue < 0 || c.DegradedQueue > 1 {
+		return fmt.Errorf("Bad degraded_queue [%v], expected [0, 1]", c.DegradedQueue)
+	}
+	positive := []struct {
+		name  string
+		value int64
+	}{
+		{"cache_size", c.CacheSize.limit()},
+		{"backend_queue_size", int64(c.BackendQueueSize)},
+		{"invalid_lines_log_rate", int64(c.InvalidLinesLogRate)},
+		{"source_dns_cache_size", int64(c.SourceDNSCacheSize)},
+	}
+	for _, p := range positive {
+		if p.value <= 0 {
+			return fmt.Errorf("Value of %s must be positive, got %d", p.name, p.value)
+		}
+	}
+	if c.LogFormat != logger.FormatText && c.LogFormat != logger.FormatJSON {
+		return fmt.Errorf("Unknown log_format [%s], expected %s or %s", c.LogFormat, logger.FormatText, logger.FormatJSON)
+	}
+	if _, err := logger.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("Bad log_level: %v", err)
+	}
+	for component, level := range c.LogLevels {
+		if component != logServer && component != logUpstreams && component != logStats && component != logAdmin {
+			return fmt.Errorf("Unknown component [%s] in log_levels", component)
+		}
+		if _, err := logger.ParseLevel(level); err != nil {
+			return fmt.Errorf("Bad log level of [%s]: %v", component, err)
+		}
+	}
+	if c.LogMaxSize < 0 || c.LogMaxBackups < 0 {
+		return fmt.Errorf("Values of log_max_size and log_max_backups can't be negative")
+	}
+	for _, rule := range c.Sampling {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("Bad sampling pattern: %v", err)
+		}
+		if rule.Rate <= 0 || rule.Rate > 1 {
+			return fmt.Errorf("Bad sampling rate [%v], expected (0, 1]", rule.Rate)
+		}
+		for _, t := range rule.Types {
+			if t != "c" && t != "ms" && t != "h" {
+				return fmt.Errorf("Bad sampling type [%s], expected c, ms or h", t)
+			}
+		}
+	}
+	for _, pattern := range append(c.Filter.Allow, c.Filter.Deny...) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("Bad filter pattern: %v", err)
+		}
+	}
+	if c.Cardinality.Enabled {
+		if c.Cardinality.Action != server.CardinalityDrop && c.Cardinality.Action != server.CardinalityOverflow {
+			return fmt.Errorf("Unknown cardinality action [%s], expected %s or %s", c.Cardinality.Action, server.CardinalityDrop, server.CardinalityOverflow)
+		}
+		if c.Cardinality.PrefixDepth < 1 || c.Cardinality.MaxNames < 1 || c.Cardinality.MaxPrefixes < 1 || c.Cardinality.MaxTotalNames < 1 || c.Cardinality.Window <= 0 {
+			return fmt.Errorf("Cardinality prefix_depth, max_names, max_prefixes, max_total_names and window must be positive")
+		}
+	}
+	if c.Mirror.Enabled {
+		if c.Mirror.Server == "" {
+			return fmt.Errorf("Mirror server is empty")
+		}
+		if c.Mirror.SampleRate <= 0 || c.Mirror.SampleRate > 1 {
+			return fmt.Errorf("Bad mirror sample_rate [%v], expected (0, 1]", c.Mirror.SampleRate)
+		}
+		if c.Mirror.CacheSize.limit() <= 0 {
+			return fmt.Errorf("Mirror cache_size must be positive, got %s", c.Mirror.CacheSize)
+		}
+	}
+	if _, err := regexp.Compile(c.Mirror.Pattern); err != nil {
+		return fmt.Errorf("Bad mirror pattern: %v", err)
+	}
+	if c.Graphite.Enabled {
+		if c.Graphite.Listen == "" {
+			return fmt.Errorf("Graphite listen is empty")
+		}
+		if err := checkMode(c.Graphite.Mode); err != nil {
+			return fmt.Errorf("Bad graphite mode: %v", err)
+		}
+		if err := checkSourceTag(c.Graphite.SourceTag); err != nil {
+			return fmt.Errorf("Bad graphite source_tag: %v", err)
+		}
+		if _, err := c.Graphite.ACL.build(); err != nil {
+			return fmt.Errorf("Bad graphite acl: %v", err)
+		}
+		if _, err := parseNetworks(c.Graphite.ProxyTrusted); err != nil {
+			return fmt.Errorf("Bad graphite proxy_protocol_trusted: %v", err)
+		}
+		if err := upstreams.CheckBackendsList(c.Graphite.Backends, c.Graphite.Mode); err != nil {
+			return fmt.Errorf("Bad graphite servers: %v", err)
+		}
+		if c.Graphite.CacheSize.limit() <= 0 || c.Graphite.BackendQueueSize <= 0 {
+			return fmt.Errorf("Graphite cache_size and backend_queue_size must be positive")
+		}
+	}
+	if c.Stats.Enabled {
+		if c.Stats.Protocol != statsTCP && c.Stats.Protocol != statsUDP && c.Stats.Protocol != statsUpstream {
+			return fmt.Errorf("Unknown stats protocol [%s], expected %s, %s or %s", c.Stats.Protocol, statsTCP, statsUDP, statsUpstream)
+		}
+		if c.Stats.Protocol != statsUpstream && c.Stats.GraphiteURI == "" {
+			return fmt.Errorf("Stats graphite_uri is empty")
+		}
+		if c.Stats.Interval <= 0 {
+			return fmt.Errorf("Stats interval must be positive, got %s", time.Duration(c.Stats.Interval))
+		}
+	}
+	if c.Admin.Enabled {
+		if c.Admin.Listen == "" {
+			return fmt.Errorf("Admin listen is empty")
+		}
+		if c.Admin.RejectedLines < 0 {
+			return fmt.Errorf("Admin rejected_lines can't be negative")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+// Package integration contains end-to-end tests of server and upstreams
+// with in-process fake statsite backends. Run them with go test.
+package integration
@@ -0,0 +1,146 @@
+package integration
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/upstreams"
+)
+
+func TestNoLoss(t *testing.T) {
+	primary := testutil.NewSink(t, "127.0.0.1:0")
+	defer primary.Kill()
+	secondary := testutil.NewSink(t, "127.0.0.1:0")
+	defer secondary.Kill()
+
+	p := startProxy(t, proxyOptions{mode: upstreams.ModePriority}, primary, secondary)
+	defer p.stop()
+
+	tcpLines := metricLines(0, 10000)
+	udpLines := metricLines(10000, 20000)
+	p.sendTCP(t, tcpLines)
+	p.sendUDP(t, udpLines)
+
+	all := append(tcpLines, udpLines...)
+	testutil.WaitFor(t, "all lines", func() bool { return primary.Count() == len(all) })
+	assertDelivered(t, all, primary)
+	if secondary.Count() != 0 {
+		t.Errorf("Secondary got %d lines while primary is alive", secondary.Count())
+	}
+}
+
+func TestTCPOrder(t *testing.T) {
+	s := testutil.NewSink(t, "127.0.0.1:0")
+	defer s.Kill()
+
+	p := startProxy(t, proxyOptions{mode: upstreams.ModePriority}, s)
+	defer p.stop()
+
+	lines := metricLines(0, 5000)
+	p.sendTCP(t, lines)
+	testutil.WaitFor(t, "all lines", func() bool { return s.Count() == len(lines) })
+	for i, line := range s.Received() {
+		if line != lines[i] {
+			t.Fatalf("Line %d is [%s], expected [%s]", i, line, lines[i])
+		}
+	}
+}
+
+func TestFailoverOrder(t *testing.T) {
+	first := testutil.NewSink(t, "127.0.0.1:0")
+	second := testutil.NewSink(t, "127.0.0.1:0")
+	third := testutil.NewSink(t, "127.0.0.1:0")
+	defer third.Kill()
+
+	p := startProxy(t, proxyOptions{mode: upstreams.ModePriority}, first, second, third)
+	defer p.stop()
+
+	sent := metricLines(0, 100)
+	p.sendTCP(t, sent)
+	testutil.WaitFor(t, "lines on first", func() bool { return first.Count() == 100 })
+
+	first.Kill()
+	settle()
+	lines := metricLines(100, 200)
+	p.sendTCP(t, lines)
+	sent = append(sent, lines...)
+	testutil.WaitFor(t, "lines on second", func() bool { return second.Count() == 100 })
+
+	second.Kill()
+	settle()
+	lines = metricLines(200, 300)
+	p.sendTCP(t, lines)
+	sent = append(sent, lines...)
+	testutil.WaitFor(t, "lines on third", func() bool { return third.Count() == 100 })
+
+	// The most priority backend gets traffic back as soon as it is available
+	first.Start()
+	defer first.Kill()
+	testutil.WaitFor(t, "reconnect to first", func() bool { return first.Connections() == 2 })
+	lines = metricLines(300, 400)
+	p.sendTCP(t, lines)
+	sent = append(sent, lines...)
+	testutil.WaitFor(t, "lines on first", func() bool { return first.Count() == 200 })
+
+	assertDelivered(t, sent, first, second, third)
+	if third.Count() != 100 {
+		t.Errorf("Third got %d lines, expected 100", third.Count())
+	}
+}
+
+func TestConnectionReset(t *testing.T) {
+	primary := testutil.NewSink(t, "127.0.0.1:0")
+	defer primary.Kill()
+	secondary := testutil.NewSink(t, "127.0.0.1:0")
+	defer secondary.Kill()
+
+	p := startProxy(t, proxyOptions{mode: upstreams.ModePriority}, primary, secondary)
+	defer p.stop()
+
+	sent := metricLines(0, 1000)
+	p.sendTCP(t, sent)
+	testutil.WaitFor(t, "lines on primary", func() bool { return primary.Count() == 1000 })
+
+	primary.Reset()
+	testutil.WaitFor(t, "reconnect to primary", func() bool { return primary.Connections() == 2 })
+	lines := metricLines(1000, 2000)
+	p.sendTCP(t, lines)
+	sent = append(sent, lines...)
+	testutil.WaitFor(t, "all lines", func() bool { return primary.Count()+secondary.Count() == len(sent) })
+	assertDelivered(t, sent, primary, secondary)
+}
+
+func TestSlowBackendIsolation(t *testing.T) {
+	slow := testutil.NewSink(t, "127.0.0.1:0")
+	defer slow.Kill()
+	fast := testutil.NewSink(t, "127.0.0.1:0")
+	defer fast.Kill()
+
+	p := startProxy(t, proxyOptions{mode: upstreams.ModeWeighted, queueSize: 10}, slow, fast)
+	defer p.stop()
+	// Writes to the paused backend block, so it must be resumed before stop
+	defer slow.Resume()
+
+	// Warm up to know how traffic is spread when both backends are fine
+	sent := metricLines(0, 1000)
+	p.sendTCP(t, sent)
+	testutil.WaitFor(t, "all lines", func() bool { return slow.Count()+fast.Count() == len(sent) })
+
+	slow.Pause()
+	fastBefore := fast.Count()
+	// Long lines fill socket buffers of the slow backend faster
+	padding := "|#padding:" + strings.Repeat("x", 1000)
+	lines := metricLines(1000, 21000)
+	for i := range lines {
+		lines[i] += padding
+	}
+	p.sendTCP(t, lines)
+	sent = append(sent, lines...)
+	// Lines of the slow backend go to the fast one when the slow queue is full
+	testutil.WaitFor(t, "fast backend gets more than its share", func() bool { return fast.Count()-fastBefore > len(lines)*3/4 })
+
+	slow.Resume()
+	testutil.WaitFor(t, "all lines", func() bool { return slow.Count()+fast.Count() == len(sent) })
+	assertDelivered(t, sent, slow, fast)
+}
@@ -0,0 +1,35 @@
+package integration
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/server"
+	"github.com/AlexAkulov/statsd-ha-proxy/upstreams"
+)
+
+func TestGraphiteRelay(t *testing.T) {
+	primary := testutil.NewSink(t, "127.0.0.1:0")
+	secondary := testutil.NewSink(t, "127.0.0.1:0")
+	defer secondary.Kill()
+
+	p := startProxy(t, proxyOptions{mode: upstreams.ModePriority, protocol: server.ProtocolGraphite}, primary, secondary)
+	defer p.stop()
+
+	var sent []string
+	for i := 0; i < 100; i++ {
+		sent = append(sent, fmt.Sprintf("test.metric%d %d.5 %d", i, i, 1500000000+i))
+	}
+	p.sendTCP(t, append(sent, "test.bad 1", "test.bad value 1500000000", "test.statsd:1|c"))
+	testutil.WaitFor(t, "lines on primary", func() bool { return primary.Count() == 100 })
+
+	primary.Kill()
+	settle()
+	lines := []string{"test.failover 1 1500000000", "test.failover 2 1500000060"}
+	p.sendUDP(t, lines)
+	sent = append(sent, lines...)
+	testutil.WaitFor(t, "lines on secondary", func() bool { return secondary.Count() == 2 })
+
+	assertDelivered(t, sent, primary, secondary)
+}
@@ -0,0 +1,147 @@
+package integration
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+	"github.com/AlexAkulov/statsd-ha-proxy/server"
+	"github.com/AlexAkulov/statsd-ha-proxy/upstreams"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+// proxy is server and upstream wired the same way as in main
+type proxy struct {
+	server   *server.Server
+	upstream *upstreams.Upstream
+}
+
+type proxyOptions struct {
+	mode      string
+	queueSize int
+	protocol  string
+}
+
+func startProxy(t *testing.T, opts proxyOptions, sinks ...*testutil.Sink) *proxy {
+	log := logger.Nop()
+	stats := graphite.New("", nil)
+	cache := queue.New(0, 100000)
+
+	p := &proxy{
+		upstream: &upstreams.Upstream{
+			Log:                      log,
+			Stats:                    stats,
+			Queue:                    cache,
+			Mode:                     opts.mode,
+			SwitchLatency:            20 * time.Millisecond,
+			BackendReconnectInterval: 50 * time.Millisecond,
+			BackendTimeout:           time.Second,
+			BackendQueueSize:         opts.queueSize,
+		},
+		server: &server.Server{
+			Log:          log,
+			Stats:        stats,
+			Queue:        cache,
+			ConfigListen: "127.0.0.1:0",
+			Protocol:     opts.protocol,
+		},
+	}
+	for _, s := range sinks {
+		p.upstream.BackendsList = append(p.upstream.BackendsList, upstreams.BackendConfig{Server: s.Addr, Weight: 1})
+	}
+	p.upstream.Start()
+	if err := p.server.Start(); err != nil {
+		p.upstream.Stop()
+		t.Fatal(err)
+	}
+	return p
+}
+
+func (p *proxy) stop() {
+	p.server.Stop()
+	p.upstream.Stop()
+}
+
+func metricLines(from, to int) []string {
+	lines := make([]string, 0, to-from)
+	for i := from; i < to; i++ {
+		lines = append(lines, fmt.Sprintf("test.metric%d:%d|c", i%100, i))
+	}
+	return lines
+}
+
+func (p *proxy) sendTCP(t *testing.T, lines []string) {
+	conn, err := net.Dial("tcp", p.server.TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w := bufio.NewWriter(conn)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sendUDP sends a few lines per packet and pauses sometimes, so loopback doesn't drop packets
+func (p *proxy) sendUDP(t *testing.T, lines []string) {
+	conn, err := net.Dial("udp", p.server.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < len(lines); i += 10 {
+		end := i + 10
+		if end > len(lines) {
+			end = len(lines)
+		}
+		var packet []byte
+		for _, line := range lines[i:end] {
+			packet = append(packet, line...)
+			packet = append(packet, '\n')
+		}
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+		if i%100 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// settle gives the proxy time to notice a closed connection. A line written to a socket
+// between close by the peer and the moment when proxy notices it is lost as with real statsite.
+func settle() {
+	time.Sleep(100 * time.Millisecond)
+}
+
+// assertDelivered checks that every line is received exactly once by sinks in total
+func assertDelivered(t *testing.T, lines []string, sinks ...*testutil.Sink) {
+	want := make(map[string]int, len(lines))
+	for _, line := range lines {
+		want[line]++
+	}
+	got := make(map[string]int, len(lines))
+	for _, s := range sinks {
+		for _, line := range s.Received() {
+			got[line]++
+		}
+	}
+	for line, n := range want {
+		if got[line] != n {
+			t.Errorf("Line [%s] is received %d times, expected %d", line, got[line], n)
+		}
+	}
+	for line, n := range got {
+		if want[line] == 0 {
+			t.Errorf("Unexpected line [%s] is received %d times", line, n)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package testutil
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// Sink is a fake statsite which remembers received lines. It can be killed, restarted,
+// paused and can reset connections.
+type Sink struct {
+	// Address of listener, it is kept when sink is restarted
+	Addr string
+
+	t           testing.TB
+	mu          sync.Mutex
+	listener    *net.TCPListener
+	conns       []*net.TCPConn
+	lines       []string
+	connections int
+	paused      bool
+	resumed     *sync.Cond
+	wg          sync.WaitGroup
+}
+
+// NewSink starts sink on addr, "127.0.0.1:0" listens on any free port
+func NewSink(t testing.TB, addr string) *Sink {
+	s := &Sink{t: t, Addr: addr}
+	s.resumed = sync.NewCond(&s.mu)
+	s.Start()
+	return s
+}
+
+// Start listens on the same address after Kill
+func (s *Sink) Start() {
+	addr, err := net.ResolveTCPAddr("tcp", s.Addr)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	// Accepted connections inherit small receive buffer, so Pause fills it quickly
+	rawConn, err := l.SyscallConn()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	rawConn.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 16*1024)
+	})
+	s.mu.Lock()
+	s.Addr = l.Addr().String()
+	s.listener = l
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.AcceptTCP()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.connections++
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go s.read(conn)
+		}
+	}()
+}
+
+func (s *Sink) read(conn *net.TCPConn) {
+	defer s.wg.Done()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, 2<<20)
+	for scanner.Scan() {
+		s.mu.Lock()
+		for s.paused {
+			s.resumed.Wait()
+		}
+		s.lines = append(s.lines, scanner.Text())
+		s.mu.Unlock()
+	}
+}
+
+func (s *Sink) closeConns(reset bool) {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+	for _, conn := range conns {
+		if reset {
+			conn.SetLinger(0)
+		}
+		conn.Close()
+	}
+}
+
+// Kill stops listening and closes connections gracefully
+func (s *Sink) Kill() {
+	s.mu.Lock()
+	s.listener.Close()
+	s.mu.Unlock()
+	s.Resume()
+	s.closeConns(false)
+	s.wg.Wait()
+}
+
+// Reset drops connections with RST, but keeps listening
+func (s *Sink) Reset() {
+	s.closeConns(true)
+}
+
+// Pause stops reading from connections, so the proxy fills socket buffers and its queues
+func (s *Sink) Pause() {
+	s.mu.Lock()
+	s.paused = true
+	s.mu.Unlock()
+}
+
+func (s *Sink) Resume() {
+	s.mu.Lock()
+	s.paused = false
+	s.mu.Unlock()
+	s.resumed.Broadcast()
+}
+
+// Count returns count of received lines
+func (s *Sink) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.lines)
+}
+
+// Connections returns count of accepted connections since start
+func (s *Sink) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+// Conns returns open connections
+func (s *Sink) Conns() []*net.TCPConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*net.TCPConn(nil), s.conns...)
+}
+
+// Received returns received lines in order of receiving
+func (s *Sink) Received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.lines...)
+}
@@ -0,0 +1,82 @@
+// Package testutil has helpers which are shared by tests of the proxy packages
+package testutil
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+// WaitFor fails the test if cond isn't true in 10 seconds
+func WaitFor(t testing.TB, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var metricTypes = map[reflect.Type]bool{
+	reflect.TypeOf(&graphite.Counter{}):   true,
+	reflect.TypeOf(&graphite.Gauge{}):     true,
+	reflect.TypeOf(&graphite.Histogram{}): true,
+}
+
+// MetricFields returns names of metric fields of struct v and names of those which are not created
+func MetricFields(v interface{}) (all []string, unregistered []string) {
+	value := reflect.ValueOf(v).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !metricTypes[field.Type] {
+			continue
+		}
+		all = append(all, field.Name)
+		if value.Field(i).IsNil() {
+			unregistered = append(unregistered, field.Name)
+		}
+	}
+	return all, unregistered
+}
+
+// StatsValues flushes stats and returns values by metric name. Percentiles of histograms
+// are merged to the name of histogram, a non-zero value is kept.
+func StatsValues(t testing.TB, stats io.WriterTo) map[string]float64 {
+	buf := &bytes.Buffer{}
+	if _, err := stats.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Fatalf("Bad stats line [%s]", line)
+		}
+		name := fields[0]
+		if pos := strings.LastIndex(name, ".p"); pos != -1 {
+			if _, err := strconv.Atoi(name[pos+2:]); err == nil {
+				name = name[:pos]
+			}
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != 0 {
+			values[name] = value
+		} else if _, ok := values[name]; !ok {
+			values[name] = 0
+		}
+	}
+	return values
+}
@@ -0,0 +1,98 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// File is a log file which can be reopened after rotation by logrotate and can rotate itself by size
+type File struct {
+	Path string
+	// File is rotated when its size exceeds MaxSize bytes, 0 disables rotation
+	MaxSize int64
+	// Count of rotated files Path.1 ... Path.N which are kept
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenFile opens log file for appending
+func OpenFile(path string, maxSize int64, maxBackups int) (*File, error) {
+	f := &File{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write writes p to the file and rotates it if it is too big
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't rotate log file %s: %v\n", f.Path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Reopen closes the file and opens Path again, it should be called after the file is moved by logrotate
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reopen()
+}
+
+func (f *File) reopen() error {
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// rotate renames Path to Path.1, Path.1 to Path.2 and so on and opens a new file
+func (f *File) rotate() error {
+	if f.MaxBackups < 1 {
+		if err := os.Truncate(f.Path, 0); err != nil {
+			return err
+		}
+		return f.reopen()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.Path, f.MaxBackups))
+	for i := f.MaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.Path, i), fmt.Sprintf("%s.%d", f.Path, i+1))
+	}
+	if err := os.Rename(f.Path, f.Path+".1"); err != nil {
+		return err
+	}
+	return f.reopen()
+}
+
+// Close the file
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
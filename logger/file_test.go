@@ -0,0 +1,76 @@
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd-ha-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.log")
+	f, err := OpenFile(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("first\n"))
+
+	// logrotate moves the file, writes go to the moved file until it is reopened
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("second\n"))
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("third\n"))
+
+	if data := readFile(t, path+".1"); data != "first\nsecond\n" {
+		t.Errorf("Moved file has [%s]", data)
+	}
+	if data := readFile(t, path); data != "third\n" {
+		t.Errorf("Reopened file has [%s]", data)
+	}
+}
+
+func TestFileRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd-ha-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.log")
+	f, err := OpenFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The oldest file is removed when there are MaxBackups files
+	for name, expected := range map[string]string{path: "line4\n", path + ".1": "line3\n", path + ".2": "line2\n"} {
+		if data := readFile(t, name); data != expected {
+			t.Errorf("File %s has [%s], expected [%s]", filepath.Base(name), data, expected)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Extra backup is kept: %v", err)
+	}
+}
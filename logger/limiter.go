@@ -0,0 +1,41 @@
+package logger
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter allows at most Burst messages per Interval, so a flood of the same errors can't fill disk
+type Limiter struct {
+	Interval time.Duration
+	Burst    int
+	// time.Now is used if it is nil
+	Now func() time.Time
+
+	mu         sync.Mutex
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// Allow returns true if message may be written and count of messages suppressed since the last allowed one
+func (l *Limiter) Allow() (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.Now != nil {
+		now = l.Now()
+	}
+	if now.Sub(l.start) >= l.Interval {
+		l.start = now
+		l.count = 0
+	}
+	if l.count >= l.Burst {
+		l.suppressed++
+		return false, 0
+	}
+	l.count++
+	suppressed := l.suppressed
+	l.suppressed = 0
+	return true, suppressed
+}
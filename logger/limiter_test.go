@@ -0,0 +1,46 @@
+package logger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := &Limiter{Interval: time.Second, Burst: 2, Now: func() time.Time { return now }}
+	for i, test := range []struct {
+		// Time since the previous message
+		after      time.Duration
+		allowed    bool
+		suppressed int
+	}{
+		{0, true, 0},
+		{100 * time.Millisecond, true, 0},
+		// Burst is used up in the interval
+		{100 * time.Millisecond, false, 0},
+		{100 * time.Millisecond, false, 0},
+		{100 * time.Millisecond, false, 0},
+		// The next interval starts with count of suppressed messages
+		{600 * time.Millisecond, true, 3},
+		{0, true, 0},
+		{0, false, 0},
+		// Suppressed count is reported once even if intervals are skipped
+		{10 * time.Second, true, 1},
+		{999 * time.Millisecond, true, 0},
+		{time.Millisecond, true, 0},
+	} {
+		now = now.Add(test.after)
+		if allowed, suppressed := l.Allow(); allowed != test.allowed || suppressed != test.suppressed {
+			t.Errorf("Message %d is allowed %v with %d suppressed, expected %v with %d", i, allowed, suppressed, test.allowed, test.suppressed)
+		}
+	}
+}
+
+func TestLimiterZeroBurst(t *testing.T) {
+	l := &Limiter{Interval: time.Second}
+	for i := 0; i < 10; i++ {
+		if allowed, _ := l.Allow(); allowed {
+			t.Fatal("Message is allowed with zero burst")
+		}
+	}
+}
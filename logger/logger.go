@@ -0,0 +1,163 @@
+// Package logger is a leveled logger with fields on top of go-kit log.
+// Every component of the proxy gets its own logger with its own level.
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/go-logfmt/logfmt"
+)
+
+// Level of log message
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warning
+	Error
+)
+
+const (
+	// FormatText is "time	LEVEL	component	message key=value ..."
+	FormatText = "text"
+	// FormatJSON is a JSON object per line
+	FormatJSON = "json"
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARNING", "ERROR"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses level name, names of go-logging levels are accepted too
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return Debug, nil
+	case "info", "notice":
+		return Info, nil
+	case "warning", "warn":
+		return Warning, nil
+	case "error", "critical":
+		return Error, nil
+	}
+	return Debug, fmt.Errorf("Unknown log level [%s]", name)
+}
+
+// Logger writes messages with level not lower than its level
+type Logger struct {
+	base  kitlog.Logger
+	level Level
+}
+
+// New returns logger which writes to w in FormatText or FormatJSON
+func New(w io.Writer, format string, level Level) (*Logger, error) {
+	var base kitlog.Logger
+	switch format {
+	case FormatText, "":
+		base = &textLogger{w: kitlog.NewSyncWriter(w)}
+		base = kitlog.With(base, "time", timestamp("2006-01-02 15:04:05"))
+	case FormatJSON:
+		base = kitlog.NewJSONLogger(kitlog.NewSyncWriter(w))
+		base = kitlog.With(base, "time", timestamp(time.RFC3339Nano))
+	default:
+		return nil, fmt.Errorf("Unknown log format [%s]", format)
+	}
+	return &Logger{base: base, level: level}, nil
+}
+
+// Nop returns logger which writes nothing
+func Nop() *Logger {
+	return &Logger{base: kitlog.NewNopLogger(), level: Error + 1}
+}
+
+func timestamp(layout string) kitlog.Valuer {
+	return func() interface{} { return time.Now().Format(layout) }
+}
+
+// With returns logger which adds keyvals to every message
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	return &Logger{base: kitlog.With(l.base, keyvals...), level: l.level}
+}
+
+// Component returns logger of subsystem with its own level
+func (l *Logger) Component(name string, level Level) *Logger {
+	return &Logger{base: kitlog.With(l.base, "component", name), level: level}
+}
+
+// Enabled returns true if messages of level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(Debug, msg, keyvals)
+}
+
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(Info, msg, keyvals)
+}
+
+func (l *Logger) Warning(msg string, keyvals ...interface{}) {
+	l.log(Warning, msg, keyvals)
+}
+
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(Error, msg, keyvals)
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.base.Log(append([]interface{}{"level", level.String(), "msg", msg}, keyvals...)...)
+}
+
+// textLogger keeps the old tab separated format and adds fields in logfmt
+type textLogger struct {
+	w io.Writer
+}
+
+func (l *textLogger) Log(keyvals ...interface{}) error {
+	var timeValue, level, component, msg interface{}
+	fields := make([]interface{}, 0, len(keyvals))
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		switch keyvals[i] {
+		case "time":
+			timeValue = keyvals[i+1]
+		case "level":
+			level = keyvals[i+1]
+		case "component":
+			component = keyvals[i+1]
+		case "msg":
+			msg = keyvals[i+1]
+		default:
+			fields = append(fields, keyvals[i], keyvals[i+1])
+		}
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%v\t%v\t", timeValue, level)
+	if component != nil {
+		fmt.Fprintf(buf, "[%v] ", component)
+	}
+	fmt.Fprint(buf, msg)
+	if len(fields) > 0 {
+		buf.WriteByte(' ')
+		if err := logfmt.NewEncoder(buf).EncodeKeyvals(fields...); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('\n')
+	_, err := l.w.Write(buf.Bytes())
+	return err
+}
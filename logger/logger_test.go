@@ -0,0 +1,122 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLevel(t *testing.T) {
+	for name, expected := range map[string]Level{
+		"debug":    Debug,
+		"INFO":     Info,
+		"notice":   Info,
+		"warn":     Warning,
+		"Warning":  Warning,
+		"error":    Error,
+		"critical": Error,
+	} {
+		if level, err := ParseLevel(name); err != nil || level != expected {
+			t.Errorf("Level [%s] is parsed as %v, %v, expected %v", name, level, err, expected)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("Unknown level is parsed")
+	}
+	if name := Level(10).String(); name != "LEVEL(10)" {
+		t.Errorf("Unknown level is named %s", name)
+	}
+}
+
+func TestLevelFiltering(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log, err := New(buf, FormatText, Warning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Component has its own level, fields of parent are kept
+	component := log.With("upstream", "graphite").Component("server", Debug)
+	log.Debug("debug")
+	log.Info("info")
+	log.Warning("warning")
+	log.Error("error")
+	component.Debug("component debug")
+
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			t.Fatalf("Bad line [%s]", line)
+		}
+		messages = append(messages, fields[1]+" "+fields[2])
+	}
+	expected := []string{"WARNING warning", "ERROR error", "DEBUG [server] component debug upstream=graphite"}
+	if strings.Join(messages, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Messages are\n%s\nexpected\n%s", strings.Join(messages, "\n"), strings.Join(expected, "\n"))
+	}
+	if log.Enabled(Info) || !log.Enabled(Error) || !component.Enabled(Debug) {
+		t.Error("Enabled doesn't follow level")
+	}
+	if Nop().Enabled(Error) {
+		t.Error("Nop logger is enabled")
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log, err := New(buf, "", Debug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Component("upstreams", Info).With("backend", "a:8125").Error("Connect fail", "error", "connection refused", "attempt", 3)
+	log.Info("Started")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines are written: %s", len(lines), buf)
+	}
+	fields := strings.SplitN(lines[0], "\t", 3)
+	if _, err := time.Parse("2006-01-02 15:04:05", fields[0]); err != nil {
+		t.Errorf("Bad time of [%s]: %v", lines[0], err)
+	}
+	// Values with spaces are quoted in logfmt
+	if expected := `ERROR	[upstreams] Connect fail backend=a:8125 error="connection refused" attempt=3`; fields[1]+"\t"+fields[2] != expected {
+		t.Errorf("Line is [%s], expected [%s]", lines[0], expected)
+	}
+	if !strings.HasSuffix(lines[1], "\tINFO\tStarted") {
+		t.Errorf("Line without fields is [%s]", lines[1])
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log, err := New(buf, FormatJSON, Debug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Component("server", Debug).Warning("Too many prefixes", "limit", 100)
+
+	var message map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &message); err != nil {
+		t.Fatalf("Bad JSON [%s]: %v", buf, err)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, message["time"].(string)); err != nil {
+		t.Errorf("Bad time: %v", err)
+	}
+	delete(message, "time")
+	expected := map[string]interface{}{"level": "WARNING", "component": "server", "msg": "Too many prefixes", "limit": float64(100)}
+	if len(message) != len(expected) {
+		t.Errorf("Message is %v, expected %v", message, expected)
+	}
+	for key, value := range expected {
+		if message[key] != value {
+			t.Errorf("Value of %s is %v, expected %v", key, message[key], value)
+		}
+	}
+
+	if _, err := New(buf, "xml", Debug); err == nil {
+		t.Error("Unknown format is accepted")
+	}
+}
@@ -0,0 +1,179 @@
+// Package queue is a memory queue of lines bounded by size in bytes
+package queue
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Lines are copied to chunks of this size, bigger lines get their own chunk
+const chunkSize = 64 * 1024
+
+type chunk struct {
+	buf  []byte
+	head int
+	tail int
+}
+
+// Queue keeps lines in pooled contiguous chunks, so a big backlog is a few large buffers
+// instead of millions of small slices for GC. Every line takes its length plus 1-2 bytes of header.
+// Zero value isn't usable, use New.
+type Queue struct {
+	maxBytes int64
+	maxLines int64
+
+	mu     sync.Mutex
+	chunks []*chunk
+	used   int64
+	lines  int64
+
+	ready chan struct{}
+	space chan struct{}
+	pool  sync.Pool
+}
+
+// New returns queue limited by maxBytes of memory and maxLines lines, zero disables a limit
+func New(maxBytes, maxLines int64) *Queue {
+	return &Queue{
+		maxBytes: maxBytes,
+		maxLines: maxLines,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+		pool: sync.Pool{New: func() interface{} {
+			return &chunk{buf: make([]byte, chunkSize)}
+		}},
+	}
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// fits must be called with locked mu. Empty queue accepts any line, so a line bigger than limit doesn't block forever.
+func (q *Queue) fits(size int64) bool {
+	if q.lines == 0 {
+		return true
+	}
+	if q.maxBytes > 0 && q.used+size > q.maxBytes {
+		return false
+	}
+	return q.maxLines == 0 || q.lines < q.maxLines
+}
+
+func lineSize(line []byte) int64 {
+	var header [binary.MaxVarintLen64]byte
+	return int64(binary.PutUvarint(header[:], uint64(len(line))) + len(line))
+}
+
+// push must be called with locked mu
+func (q *Queue) push(line []byte, size int64) {
+	var c *chunk
+	if len(q.chunks) > 0 {
+		c = q.chunks[len(q.chunks)-1]
+	}
+	if c == nil || int64(len(c.buf)-c.tail) < size {
+		if size > chunkSize {
+			c = &chunk{buf: make([]byte, size)}
+		} else {
+			c = q.pool.Get().(*chunk)
+			c.head, c.tail = 0, 0
+		}
+		q.chunks = append(q.chunks, c)
+	}
+	c.tail += binary.PutUvarint(c.buf[c.tail:], uint64(len(line)))
+	c.tail += copy(c.buf[c.tail:], line)
+	q.used += size
+	q.lines++
+}
+
+// TryPut copies line to queue, returns false if queue is full
+func (q *Queue) TryPut(line []byte) bool {
+	size := lineSize(line)
+	q.mu.Lock()
+	if !q.fits(size) {
+		q.mu.Unlock()
+		return false
+	}
+	q.push(line, size)
+	q.mu.Unlock()
+	notify(q.ready)
+	return true
+}
+
+// Put copies line to queue, waits while queue is full. Returns false if done is closed before line is queued.
+func (q *Queue) Put(line []byte, done <-chan struct{}) bool {
+	if q.TryPut(line) {
+		return true
+	}
+	for {
+		select {
+		case <-done:
+			return false
+		case <-q.space:
+		}
+		if q.TryPut(line) {
+			// Other writers may wait too
+			notify(q.space)
+			return true
+		}
+	}
+}
+
+// Get returns the oldest line or false if queue is empty. Returned line is a copy and may be kept.
+func (q *Queue) Get() ([]byte, bool) {
+	q.mu.Lock()
+	if q.lines == 0 {
+		q.mu.Unlock()
+		return nil, false
+	}
+	c := q.chunks[0]
+	length, n := binary.Uvarint(c.buf[c.head:c.tail])
+	start := c.head + n
+	line := make([]byte, length)
+	copy(line, c.buf[start:])
+	c.head = start + int(length)
+	q.used -= int64(c.head - start + n)
+	q.lines--
+	if c.head == c.tail {
+		q.chunks[0] = nil
+		q.chunks = q.chunks[1:]
+		if len(c.buf) == chunkSize {
+			q.pool.Put(c)
+		}
+	}
+	q.mu.Unlock()
+	notify(q.space)
+	return line, true
+}
+
+// Ready is signaled after lines are put, reader should call Get until queue is empty before waiting on it again
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Used returns memory used by queued lines in bytes
+func (q *Queue) Used() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.used
+}
+
+// Len returns count of queued lines
+func (q *Queue) Len() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lines
+}
+
+// MaxBytes returns memory limit in bytes, 0 if queue is limited only by lines
+func (q *Queue) MaxBytes() int64 {
+	return q.maxBytes
+}
+
+// MaxLines returns limit of lines, 0 if queue is limited only by memory
+func (q *Queue) MaxLines() int64 {
+	return q.maxLines
+}
@@ -0,0 +1,167 @@
+package queue
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestOrder(t *testing.T) {
+	q := New(0, 0)
+	var lines [][]byte
+	for i := 0; i < 10000; i++ {
+		lines = append(lines, []byte(fmt.Sprintf("metric.%d:%d|c", i, i)))
+	}
+	// Lines bigger than chunk and empty ones
+	lines = append(lines, bytes.Repeat([]byte("a"), chunkSize*2), []byte{}, []byte("last:1|c"))
+	for _, line := range lines {
+		if !q.TryPut(line) {
+			t.Fatal("Unlimited queue is full")
+		}
+	}
+	if q.Len() != int64(len(lines)) {
+		t.Fatalf("Len is %d, expected %d", q.Len(), len(lines))
+	}
+	for i, expected := range lines {
+		line, ok := q.Get()
+		if !ok {
+			t.Fatalf("Queue is empty after %d lines", i)
+		}
+		if !bytes.Equal(line, expected) {
+			t.Fatalf("Line %d is [%.20s], expected [%.20s]", i, line, expected)
+		}
+	}
+	if _, ok := q.Get(); ok {
+		t.Fatal("Queue isn't empty")
+	}
+	if q.Used() != 0 {
+		t.Fatalf("Used is %d for empty queue", q.Used())
+	}
+}
+
+func TestLimits(t *testing.T) {
+	line := []byte("metric:1|c")
+	size := lineSize(line)
+
+	q := New(size*10, 0)
+	for i := 0; i < 10; i++ {
+		if !q.TryPut(line) {
+			t.Fatalf("Queue is full after %d lines", i)
+		}
+	}
+	if q.TryPut(line) {
+		t.Fatal("Line is put over limit of bytes")
+	}
+	if q.Used() != size*10 {
+		t.Fatalf("Used is %d, expected %d", q.Used(), size*10)
+	}
+	q.Get()
+	if q.Used() != size*9 || !q.TryPut(line) {
+		t.Fatal("Space isn't released by Get")
+	}
+
+	q = New(0, 5)
+	for i := 0; i < 5; i++ {
+		q.TryPut(line)
+	}
+	if q.TryPut(line) {
+		t.Fatal("Line is put over limit of lines")
+	}
+
+	// Empty queue accepts line bigger than limit
+	q = New(10, 0)
+	if !q.TryPut(bytes.Repeat([]byte("a"), 100)) {
+		t.Fatal("Big line isn't put to empty queue")
+	}
+}
+
+func TestPutWaits(t *testing.T) {
+	q := New(0, 1)
+	q.TryPut([]byte("first"))
+
+	put := make(chan bool)
+	go func() {
+		put <- q.Put([]byte("second"), nil)
+	}()
+	select {
+	case <-put:
+		t.Fatal("Put doesn't wait for space")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.Get()
+	select {
+	case ok := <-put:
+		if !ok {
+			t.Fatal("Put failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Put isn't woken by Get")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		put <- q.Put([]byte("third"), done)
+	}()
+	close(done)
+	if <-put {
+		t.Fatal("Put succeeded to full queue after done")
+	}
+}
+
+const backlogLines = 100000
+
+// Backlog is queued and then read, like when all backends are down for a while.
+// Queued lines are alive during GC, so pauses and GC count are reported with allocations.
+// Lines are put from a shared buffer, put function must copy line if it keeps it.
+func benchmarkBacklog(b *testing.B, put func([]byte), get func() []byte) {
+	lines := make([][]byte, 100)
+	for i := range lines {
+		lines[i] = []byte(fmt.Sprintf("app.service%d.requests.duration:%d|ms", i, i*7))
+	}
+	var before, backlog, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < backlogLines; i++ {
+			put(lines[i%len(lines)])
+		}
+		if n == 0 {
+			b.StopTimer()
+			runtime.GC()
+			runtime.ReadMemStats(&backlog)
+			b.StartTimer()
+		}
+		for i := 0; i < backlogLines; i++ {
+			get()
+		}
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	// Objects which GC has to scan while backlog is queued
+	b.ReportMetric(float64(backlog.HeapObjects)-float64(before.HeapObjects), "backlog-objects")
+	b.ReportMetric(float64(after.NumGC-before.NumGC-1)/float64(b.N), "gc/op")
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+}
+
+func BenchmarkBacklogQueue(b *testing.B) {
+	q := New(0, backlogLines)
+	benchmarkBacklog(b, func(line []byte) {
+		q.TryPut(line)
+	}, func() []byte {
+		line, _ := q.Get()
+		return line
+	})
+}
+
+func BenchmarkBacklogChannel(b *testing.B) {
+	c := make(chan []byte, backlogLines)
+	benchmarkBacklog(b, func(line []byte) {
+		c <- append([]byte(nil), line...)
+	}, func() []byte {
+		return <-c
+	})
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+// ACL is access control list of listener by address of client. UDP packets are checked one by one,
+// TCP connections are checked on accept and by client address from PROXY protocol header if it is enabled.
+// Trusted PROXY protocol peers are checked only by client address.
+type ACL struct {
+	// Only clients from these networks are accepted if it is set
+	Allow []*net.IPNet
+	// Clients from these networks are rejected even if they are allowed
+	Deny []*net.IPNet
+	// Clients from network of a rule may send only metrics with one of its prefixes,
+	// the most specific rule is applied. Clients out of rules may send any metrics.
+	Prefixes []PrefixRule
+
+	statsRejectedPackets *graphite.Counter
+	statsRejectedConns   *graphite.Counter
+	statsRejectedLines   *graphite.Counter
+}
+
+// PrefixRule restricts names of metrics of clients from Network
+type PrefixRule struct {
+	Network  *net.IPNet
+	Prefixes []string
+}
+
+// ParseNetwork parses CIDR like "10.1.0.0/16" or a single address
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+func (a *ACL) start(stats *graphite.Graphite, statsName func(string) string) {
+	a.statsRejectedPackets = stats.NewCounter(statsName("acl.rejectedPackets"))
+	a.statsRejectedConns = stats.NewCounter(statsName("acl.rejectedConnections"))
+	a.statsRejectedLines = stats.NewCounter(statsName("acl.rejectedLines"))
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed returns false if client is denied or isn't allowed
+func (a *ACL) allowed(ip net.IP) bool {
+	if len(a.Allow) > 0 && !containsIP(a.Allow, ip) {
+		return false
+	}
+	return !containsIP(a.Deny, ip)
+}
+
+// rule returns the most specific prefix rule of client or nil if client may send any metrics
+func (a *ACL) rule(ip net.IP) *PrefixRule {
+	var (
+		matched *PrefixRule
+		best    = -1
+	)
+	for i := range a.Prefixes {
+		rule := &a.Prefixes[i]
+		if !rule.Network.Contains(ip) {
+			continue
+		}
+		if ones, _ := rule.Network.Mask.Size(); ones > best {
+			matched, best = rule, ones
+		}
+	}
+	return matched
+}
+
+// allowedName returns true if rule is nil or name starts with one of its prefixes
+func (r *PrefixRule) allowedName(name []byte) bool {
+	if r == nil {
+		return true
+	}
+	for _, prefix := range r.Prefixes {
+		if len(name) >= len(prefix) && string(name[:len(prefix)]) == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns IP of TCP or UDP address, nil for others
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
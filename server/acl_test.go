@@ -0,0 +1,247 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+func mustParseNetworks(t *testing.T, networks ...string) []*net.IPNet {
+	var result []*net.IPNet
+	for _, s := range networks {
+		network, err := ParseNetwork(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, network)
+	}
+	return result
+}
+
+func TestParseNetwork(t *testing.T) {
+	for s, expected := range map[string]string{
+		"10.1.0.0/16": "10.1.0.0/16",
+		"10.1.2.3/16": "10.1.0.0/16",
+		"10.1.2.3":    "10.1.2.3/32",
+		"2001:db8::1": "2001:db8::1/128",
+	} {
+		network, err := ParseNetwork(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if network.String() != expected {
+			t.Errorf("Network of [%s] is [%s], expected [%s]", s, network, expected)
+		}
+	}
+	for _, s := range []string{"", "10.1.0.0/33", "host"} {
+		if _, err := ParseNetwork(s); err == nil {
+			t.Errorf("Network [%s] is parsed", s)
+		}
+	}
+}
+
+func TestACLRules(t *testing.T) {
+	acl := &ACL{
+		Allow: mustParseNetworks(t, "10.0.0.0/8"),
+		Deny:  mustParseNetworks(t, "10.9.0.0/16"),
+		Prefixes: []PrefixRule{
+			{Network: mustParseNetworks(t, "10.1.0.0/16")[0], Prefixes: []string{"team_a."}},
+			{Network: mustParseNetworks(t, "10.1.2.0/24")[0], Prefixes: []string{"team_b.", "common."}},
+		},
+	}
+	for ip, expected := range map[string]bool{
+		"10.1.2.3":        true,
+		"10.9.0.1":        false,
+		"192.0.2.1":       false,
+		"::ffff:10.1.2.3": true,
+	} {
+		if acl.allowed(net.ParseIP(ip)) != expected {
+			t.Errorf("Client %s is allowed %v, expected %v", ip, !expected, expected)
+		}
+	}
+	for _, test := range []struct {
+		ip      string
+		name    string
+		allowed bool
+	}{
+		{"10.1.2.3", "team_b.requests", true},
+		{"10.1.2.3", "common.requests", true},
+		// The most specific rule is applied
+		{"10.1.2.3", "team_a.requests", false},
+		{"10.1.3.1", "team_a.requests", true},
+		{"10.1.3.1", "team_a", false},
+		// Clients out of rules may send any metrics
+		{"10.2.0.1", "anything", true},
+	} {
+		if acl.rule(net.ParseIP(test.ip)).allowedName([]byte(test.name)) != test.allowed {
+			t.Errorf("Metric %s of %s is allowed %v, expected %v", test.name, test.ip, !test.allowed, test.allowed)
+		}
+	}
+}
+
+func startACLServer(t *testing.T, acl *ACL, proxyProtocol bool, trusted ...string) (*Server, *queue.Queue) {
+	cache := queue.New(0, 100)
+	s := &Server{
+		ConfigListen:         "127.0.0.1:0",
+		Queue:                cache,
+		Stats:                graphite.New("", nil),
+		ACL:                  acl,
+		ProxyProtocol:        proxyProtocol,
+		ProxyProtocolTrusted: mustParseNetworks(t, trusted...),
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s, cache
+}
+
+// waitForCounters waits until counters get expected values. Counters are reset by flush, so values are summed.
+func waitForCounters(t *testing.T, stats *graphite.Graphite, expected map[string]float64) {
+	sums := make(map[string]float64)
+	testutil.WaitFor(t, "counters", func() bool {
+		for name, value := range testutil.StatsValues(t, stats) {
+			sums[name] += value
+		}
+		for name, value := range expected {
+			if sums[name] != value {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// expectClosed fails if server doesn't close conn
+func expectClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection isn't closed: %v", err)
+	}
+}
+
+func TestACLDeny(t *testing.T) {
+	s, cache := startACLServer(t, &ACL{Deny: mustParseNetworks(t, "127.0.0.0/8")}, false)
+	defer s.Stop()
+
+	udp, err := net.Dial("udp", s.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.Write([]byte("app.a:1|c\napp.b:1|c"))
+	tcp, err := net.Dial("tcp", s.TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	tcp.Write([]byte("app.c:1|c\n"))
+	expectClosed(t, tcp)
+
+	waitForCounters(t, s.Stats, map[string]float64{
+		"incoming.acl.rejectedPackets":     1,
+		"incoming.acl.rejectedConnections": 1,
+	})
+	if cache.Len() != 0 {
+		t.Errorf("%d lines of denied client are accepted", cache.Len())
+	}
+}
+
+func TestACLPrefixes(t *testing.T) {
+	acl := &ACL{
+		Prefixes: []PrefixRule{
+			{Network: mustParseNetworks(t, "127.0.0.0/8")[0], Prefixes: []string{"team_a."}},
+			{Network: mustParseNetworks(t, "127.0.0.1")[0], Prefixes: []string{"team_b."}},
+		},
+	}
+	s, cache := startACLServer(t, acl, false)
+	defer s.Stop()
+
+	udp, err := net.Dial("udp", s.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.Write([]byte("team_a.x:1|c\nteam_b.x:1|c"))
+	tcp, err := net.Dial("tcp", s.TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	tcp.Write([]byte("team_b.y:1|c\nteam_a.y:1|c\n"))
+
+	waitForCounters(t, s.Stats, map[string]float64{"incoming.acl.rejectedLines": 2})
+	testutil.WaitFor(t, "accepted lines", func() bool { return cache.Len() == 2 })
+	for i := 0; i < 2; i++ {
+		line, _ := cache.Get()
+		if string(line[:7]) != "team_b." {
+			t.Errorf("Line [%s] is accepted", line)
+		}
+	}
+}
+
+// Clients behind trusted load balancer are checked by address from PROXY header
+func TestACLProxyProtocol(t *testing.T) {
+	acl := &ACL{
+		Allow:    mustParseNetworks(t, "10.1.0.0/16"),
+		Prefixes: []PrefixRule{{Network: mustParseNetworks(t, "10.1.0.0/16")[0], Prefixes: []string{"team_a."}}},
+	}
+	s, cache := startACLServer(t, acl, true, "127.0.0.1")
+	defer s.Stop()
+
+	allowed, err := net.Dial("tcp", s.TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close()
+	allowed.Write([]byte("PROXY TCP4 10.1.2.3 10.0.0.1 40000 8125\r\nteam_a.x:1|c\nteam_b.x:1|c\n"))
+	denied, err := net.Dial("tcp", s.TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.Close()
+	denied.Write([]byte("PROXY TCP4 10.2.0.1 10.0.0.1 40000 8125\r\nteam_a.y:1|c\n"))
+	expectClosed(t, denied)
+
+	waitForCounters(t, s.Stats, map[string]float64{
+		"incoming.acl.rejectedLines":       1,
+		"incoming.acl.rejectedConnections": 1,
+	})
+	testutil.WaitFor(t, "accepted line", func() bool { return cache.Len() == 1 })
+	if line, _ := cache.Get(); string(line) != "team_a.x:1|c" {
+		t.Errorf("Line [%s] is accepted", line)
+	}
+}
+
+// Peer which isn't trusted can't pass ACL by a forged PROXY header
+func TestACLProxyProtocolForged(t *testing.T) {
+	acl := &ACL{Allow: mustParseNetworks(t, "10.1.0.0/16")}
+	for _, test := range []struct {
+		name    string
+		trusted []string
+		counter string
+	}{
+		{"untrusted peer", []string{"10.0.0.0/8"}, "incoming.proxyProtocolErrors"},
+		// Without trusted peers ACL checks the peer too
+		{"no trusted peers", nil, "incoming.acl.rejectedConnections"},
+	} {
+		s, cache := startACLServer(t, acl, true, test.trusted...)
+		conn, err := net.Dial("tcp", s.TCPAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("PROXY TCP4 10.1.2.3 10.0.0.1 40000 8125\r\napp.a:1|c\n"))
+		expectClosed(t, conn)
+		conn.Close()
+		waitForCounters(t, s.Stats, map[string]float64{test.counter: 1})
+		s.Stop()
+		if cache.Len() != 0 {
+			t.Errorf("%s: line of forged client is accepted", test.name)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+const (
+	// CardinalityDrop drops lines with new names when limit of prefix is reached
+	CardinalityDrop = "drop"
+	// CardinalityOverflow renames lines with new names to "<prefix>.overflow" when limit of prefix is reached
+	// and to "overflow" when limit of prefixes is reached
+	CardinalityOverflow = "overflow"
+)
+
+// cardinalityShards is count of parts of limiter with own lock, prefix belongs to one of them by hash
+const cardinalityShards = 16
+
+// CardinalityLimiter limits count of distinct metric names per prefix in a sliding window.
+// Names which are already known are always accepted, so existing metrics are not broken
+// when somebody starts to send garbage under the same prefix.
+type CardinalityLimiter struct {
+	// Count of name parts separated by '.' which make prefix, the last part is never included
+	PrefixDepth int
+	// Max count of distinct names per prefix in Window
+	MaxNames int
+	// Max count of tracked prefixes, names with new prefixes are limited as a whole when it is reached
+	MaxPrefixes int
+	// Max count of tracked names of all prefixes, so memory of limiter is bounded. New names of every prefix
+	// are limited when it is reached. Zero is no limit.
+	MaxTotalNames int
+	Window        time.Duration
+	// CardinalityDrop or CardinalityOverflow
+	Action string
+
+	log    *logger.Logger
+	shards [cardinalityShards]cardinalityShard
+	// Totals of all shards, they are changed atomically
+	prefixesCount  int64
+	namesCount     int64
+	overLimitCount int64
+	// 1 when too many prefixes or names was reported in the current half of window
+	prefixesReported int32
+	namesReported    int32
+	// Unix time in nanoseconds when shards were rotated last time
+	rotatedAt int64
+
+	statsDropped    *graphite.Counter
+	statsOverflowed *graphite.Counter
+	statsPrefixes   *graphite.Gauge
+	statsNames      *graphite.Gauge
+	statsOverLimit  *graphite.Gauge
+}
+
+// cardinalityShard keeps prefixes with the same hash
+type cardinalityShard struct {
+	mu       sync.Mutex
+	prefixes map[string]*prefixNames
+}
+
+// prefixNames keeps names of two halves of window, names of previous half are still known
+type prefixNames struct {
+	current   map[string]struct{}
+	previous  map[string]struct{}
+	overLimit bool
+}
+
+func (c *CardinalityLimiter) start(stats *graphite.Graphite, statsName func(string) string, log *logger.Logger) {
+	c.log = log
+	for i := range c.shards {
+		c.shards[i].prefixes = make(map[string]*prefixNames)
+	}
+	c.rotatedAt = time.Now().UnixNano()
+	c.statsDropped = stats.NewCounter(statsName("cardinality.dropped"))
+	c.statsOverflowed = stats.NewCounter(statsName("cardinality.overflowed"))
+	c.statsPrefixes = stats.NewGauge(statsName("cardinality.prefixes"))
+	c.statsNames = stats.NewGauge(statsName("cardinality.names"))
+	c.statsOverLimit = stats.NewGauge(statsName("cardinality.overLimitPrefixes"))
+}
+
+// prefix returns first PrefixDepth parts of name but not the last part, so "api.<id>" has prefix "api"
+// with any depth. Names without dots have empty prefix.
+func (c *CardinalityLimiter) prefix(name []byte) []byte {
+	pos := 0
+	for i := 0; i < c.PrefixDepth; i++ {
+		next := bytes.IndexByte(name[pos:], '.')
+		if next == -1 {
+			break
+		}
+		pos += next + 1
+	}
+	if pos == 0 {
+		return name[:0]
+	}
+	return name[:pos-1]
+}
+
+// overflowName returns name which replaces new names of prefix
+func overflowName(prefix []byte) []byte {
+	if len(prefix) == 0 {
+		return []byte(CardinalityOverflow)
+	}
+	overflow := make([]byte, 0, len(prefix)+len(".overflow"))
+	overflow = append(overflow, prefix...)
+	return append(overflow, ".overflow"...)
+}
+
+// shard returns shard of prefix by FNV-1a hash
+func (c *CardinalityLimiter) shard(prefix []byte) *cardinalityShard {
+	h := uint32(2166136261)
+	for _, b := range prefix {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return &c.shards[h%cardinalityShards]
+}
+
+// reject applies Action to line with new name
+func (c *CardinalityLimiter) reject(prefix []byte) []byte {
+	if c.Action == CardinalityOverflow {
+		c.statsOverflowed.Add(1)
+		return overflowName(prefix)
+	}
+	c.statsDropped.Add(1)
+	return nil
+}
+
+// limit returns nil if line should be dropped, name if it is accepted or overflow name
+func (c *CardinalityLimiter) limit(name []byte) []byte {
+	c.rotate()
+	prefix := c.prefix(name)
+	sh := c.shard(prefix)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	p, ok := sh.prefixes[string(prefix)]
+	if !ok {
+		if c.MaxPrefixes > 0 && atomic.LoadInt64(&c.prefixesCount) >= int64(c.MaxPrefixes) {
+			if atomic.CompareAndSwapInt32(&c.prefixesReported, 0, 1) {
+				c.log.Warning("Too many prefixes", "limit", c.MaxPrefixes, "window", c.Window, "action", c.Action)
+			}
+			return c.reject(nil)
+		}
+		p = &prefixNames{current: make(map[string]struct{}), previous: make(map[string]struct{})}
+		sh.prefixes[string(prefix)] = p
+		c.statsPrefixes.Set(float64(atomic.AddInt64(&c.prefixesCount, 1)))
+	}
+	if _, ok := p.current[string(name)]; ok {
+		return name
+	}
+	if _, ok := p.previous[string(name)]; ok {
+		delete(p.previous, string(name))
+		p.current[string(name)] = struct{}{}
+		return name
+	}
+	if len(p.current)+len(p.previous) >= c.MaxNames {
+		if !p.overLimit {
+			p.overLimit = true
+			c.statsOverLimit.Set(float64(atomic.AddInt64(&c.overLimitCount, 1)))
+			c.log.Warning("Too many distinct names", "prefix", string(prefix), "limit", c.MaxNames, "window", c.Window, "action", c.Action)
+		}
+		return c.reject(prefix)
+	}
+	names := atomic.AddInt64(&c.namesCount, 1)
+	if c.MaxTotalNames > 0 && names > int64(c.MaxTotalNames) {
+		atomic.AddInt64(&c.namesCount, -1)
+		if atomic.CompareAndSwapInt32(&c.namesReported, 0, 1) {
+			c.log.Warning("Too many distinct names of all prefixes", "limit", c.MaxTotalNames, "window", c.Window, "action", c.Action)
+		}
+		return c.reject(prefix)
+	}
+	c.statsNames.Set(float64(names))
+	p.current[string(name)] = struct{}{}
+	return name
+}
+
+// rotate forgets names which were not seen in the last window. Shards are rotated one by one,
+// the first line after half of window does it.
+func (c *CardinalityLimiter) rotate() {
+	now := time.Now().UnixNano()
+	rotatedAt := atomic.LoadInt64(&c.rotatedAt)
+	if time.Duration(now-rotatedAt) < c.Window/2 || !atomic.CompareAndSwapInt64(&c.rotatedAt, rotatedAt, now) {
+		return
+	}
+	atomic.StoreInt32(&c.prefixesReported, 0)
+	atomic.StoreInt32(&c.namesReported, 0)
+	for i := range c.shards {
+		c.rotateShard(&c.shards[i])
+	}
+}
+
+func (c *CardinalityLimiter) rotateShard(sh *cardinalityShard) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	var forgotten, removed, notOverLimit int64
+	for prefix, p := range sh.prefixes {
+		forgotten += int64(len(p.previous))
+		// Names of previous half are forgotten now, so prefix without new names is empty
+		if len(p.current) == 0 {
+			delete(sh.prefixes, prefix)
+			removed++
+			if p.overLimit {
+				notOverLimit++
+			}
+			continue
+		}
+		p.previous = p.current
+		p.current = make(map[string]struct{})
+		if p.overLimit && len(p.previous) < c.MaxNames {
+			p.overLimit = false
+			notOverLimit++
+		}
+	}
+	c.statsPrefixes.Set(float64(atomic.AddInt64(&c.prefixesCount, -removed)))
+	c.statsNames.Set(float64(atomic.AddInt64(&c.namesCount, -forgotten)))
+	c.statsOverLimit.Set(float64(atomic.AddInt64(&c.overLimitCount, -notOverLimit)))
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+func newTestLimiter(action string, maxNames, maxPrefixes int) (*CardinalityLimiter, *graphite.Graphite) {
+	stats := graphite.New("", nil)
+	c := &CardinalityLimiter{PrefixDepth: 2, MaxNames: maxNames, MaxPrefixes: maxPrefixes, Window: time.Hour, Action: action}
+	c.start(stats, func(name string) string { return name }, logger.Nop())
+	return c, stats
+}
+
+// expire makes limiter rotate on the next line
+func expire(c *CardinalityLimiter) {
+	atomic.StoreInt64(&c.rotatedAt, time.Now().Add(-c.Window).UnixNano())
+}
+
+func TestCardinalityPrefix(t *testing.T) {
+	c := &CardinalityLimiter{PrefixDepth: 2}
+	for name, expected := range map[string]string{
+		"app.service.requests.count": "app.service",
+		"app.service.requests":       "app.service",
+		// The last part is never in prefix, it is where ids are
+		"api.req123":   "api",
+		"api.":         "api",
+		"requests":     "",
+		"app.a.b.c.d.": "app.a",
+	} {
+		if prefix := string(c.prefix([]byte(name))); prefix != expected {
+			t.Errorf("Prefix of [%s] is [%s], expected [%s]", name, prefix, expected)
+		}
+	}
+}
+
+func TestCardinalityLimit(t *testing.T) {
+	for _, action := range []string{CardinalityDrop, CardinalityOverflow} {
+		c, stats := newTestLimiter(action, 10, 100)
+		accepted, limited := 0, 0
+		for i := 0; i < 1000; i++ {
+			name := fmt.Sprintf("api.req%d", i)
+			switch result := c.limit([]byte(name)); {
+			case string(result) == name:
+				accepted++
+			case action == CardinalityDrop && result == nil, action == CardinalityOverflow && string(result) == "api.overflow":
+				limited++
+			default:
+				t.Fatalf("%s: name [%s] is limited to [%s]", action, name, result)
+			}
+		}
+		if accepted != 10 || limited != 990 {
+			t.Errorf("%s: %d names are accepted and %d are limited, expected 10 and 990", action, accepted, limited)
+		}
+		// Known names are always accepted
+		if result := c.limit([]byte("api.req1")); string(result) != "api.req1" {
+			t.Errorf("%s: known name is limited to [%s]", action, result)
+		}
+		if c.prefixesCount != 1 {
+			t.Errorf("%s: %d prefixes are tracked, expected 1", action, c.prefixesCount)
+		}
+		values := testutil.StatsValues(t, stats)
+		if values["cardinality."+map[string]string{CardinalityDrop: "dropped", CardinalityOverflow: "overflowed"}[action]] != 990 {
+			t.Errorf("%s: limited names aren't counted: %v", action, values)
+		}
+	}
+}
+
+func TestCardinalityMaxPrefixes(t *testing.T) {
+	for _, test := range []struct {
+		action   string
+		expected string
+	}{
+		{CardinalityDrop, ""},
+		{CardinalityOverflow, "overflow"},
+	} {
+		c, stats := newTestLimiter(test.action, 10, 3)
+		for i := 0; i < 3; i++ {
+			name := fmt.Sprintf("app%d.requests", i)
+			if result := c.limit([]byte(name)); string(result) != name {
+				t.Fatalf("%s: name [%s] is limited to [%s]", test.action, name, result)
+			}
+		}
+		for i := 3; i < 100; i++ {
+			if result := c.limit([]byte(fmt.Sprintf("app%d.requests", i))); string(result) != test.expected {
+				t.Fatalf("%s: name with new prefix is limited to [%s], expected [%s]", test.action, result, test.expected)
+			}
+		}
+		// Names of known prefixes are still accepted
+		if result := c.limit([]byte("app0.errors")); string(result) != "app0.errors" {
+			t.Errorf("%s: name of known prefix is limited to [%s]", test.action, result)
+		}
+		if c.prefixesCount != 3 {
+			t.Errorf("%s: %d prefixes are tracked, expected 3", test.action, c.prefixesCount)
+		}
+		values := testutil.StatsValues(t, stats)
+		if values["cardinality.dropped"]+values["cardinality.overflowed"] != 97 {
+			t.Errorf("%s: names with new prefixes aren't counted: %v", test.action, values)
+		}
+	}
+}
+
+func TestCardinalityRotate(t *testing.T) {
+	c, _ := newTestLimiter(CardinalityDrop, 2, 100)
+	c.limit([]byte("api.a"))
+	c.limit([]byte("api.b"))
+	if c.limit([]byte("api.c")) != nil {
+		t.Fatal("Name over limit is accepted")
+	}
+
+	// Names of previous half of window are still known
+	expire(c)
+	if string(c.limit([]byte("api.a"))) != "api.a" {
+		t.Fatal("Name of previous half of window is forgotten")
+	}
+	// Names which are not seen during the whole window are forgotten
+	expire(c)
+	if string(c.limit([]byte("api.c"))) != "api.c" {
+		t.Error("Space of forgotten name isn't released")
+	}
+	if string(c.limit([]byte("api.a"))) != "api.a" {
+		t.Error("Name which is seen in window is forgotten")
+	}
+
+	// Prefixes without names are removed
+	c.limit([]byte("other.a"))
+	expire(c)
+	c.limit([]byte("api.a"))
+	expire(c)
+	c.limit([]byte("api.a"))
+	if _, ok := c.shard([]byte("other")).prefixes["other"]; ok {
+		t.Error("Prefix without names isn't removed")
+	}
+}
+
+func TestCardinalityMaxTotalNames(t *testing.T) {
+	c, stats := newTestLimiter(CardinalityOverflow, 10, 100)
+	c.MaxTotalNames = 25
+	accepted := 0
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("app%d.req%d", i%5, i)
+		switch result := string(c.limit([]byte(name))); result {
+		case name:
+			accepted++
+		case fmt.Sprintf("app%d.overflow", i%5):
+		default:
+			t.Fatalf("Name [%s] is limited to [%s]", name, result)
+		}
+	}
+	if accepted != 25 {
+		t.Errorf("%d names are accepted, expected 25", accepted)
+	}
+	if values := testutil.StatsValues(t, stats); values["cardinality.names"] != 25 || values["cardinality.overflowed"] != 25 {
+		t.Errorf("Limited names aren't counted: %v", values)
+	}
+
+	// Forgotten names release space of all prefixes
+	expire(c)
+	c.limit([]byte("app0.req0"))
+	expire(c)
+	c.limit([]byte("app0.req0"))
+	if c.namesCount != 1 || c.prefixesCount != 1 {
+		t.Errorf("%d names of %d prefixes are tracked after rotation, expected 1 of 1", c.namesCount, c.prefixesCount)
+	}
+	if result := string(c.limit([]byte("app1.new"))); result != "app1.new" {
+		t.Errorf("New name is limited to [%s] after rotation", result)
+	}
+}
+
+func TestCardinalityConcurrent(t *testing.T) {
+	c, _ := newTestLimiter(CardinalityDrop, 100, 1000)
+	c.MaxTotalNames = 1000
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.limit([]byte(fmt.Sprintf("app%d.%d.req%d", g, i%20, i)))
+				if i%100 == 0 {
+					expire(c)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// Totals are the same as counts of shards
+	var prefixes, names int64
+	for i := range c.shards {
+		for _, p := range c.shards[i].prefixes {
+			prefixes++
+			names += int64(len(p.current) + len(p.previous))
+		}
+	}
+	if prefixes != c.prefixesCount || names != c.namesCount || names > int64(c.MaxTotalNames) {
+		t.Errorf("Shards have %d names of %d prefixes, totals are %d of %d", names, prefixes, c.namesCount, c.prefixesCount)
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"io"
+	"net"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+// runMetricsScenario sends lines which touch every metric of server with cardinality action
+// and returns flushed stats, names of declared metrics and names of not registered ones
+func runMetricsScenario(t *testing.T, action string) (map[string]float64, []string, []string) {
+	cache := queue.New(0, 100)
+	// Lookup of 127.0.0.1 fails
+	resolver, lookup := newTestResolver(map[string]string{"10.0.0.1": "app1"}, time.Minute, 10)
+	s := &Server{
+		ConfigListen: "127.0.0.1:0",
+		Queue:        cache,
+		Stats:        graphite.New("", nil),
+		Sampling:     []SamplingRule{{Pattern: regexp.MustCompile(`^sampled\.`), Rate: 0.000001}},
+		Deny:         []*regexp.Regexp{regexp.MustCompile(`^denied\.`)},
+		// Every TCP connection of scenario starts with PROXY header
+		ProxyProtocol: true,
+		SourceTag:     "source",
+		Resolver:      resolver,
+		ACL: &ACL{
+			Deny:     mustParseNetworks(t, "127.0.0.2", "10.0.0.9"),
+			Prefixes: []PrefixRule{{Network: mustParseNetworks(t, "10.0.0.1")[0], Prefixes: []string{"app."}}},
+		},
+		Cardinality: &CardinalityLimiter{
+			PrefixDepth: 1,
+			MaxNames:    1,
+			Window:      time.Minute,
+			Action:      action,
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	udp, err := net.Dial("udp", s.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	if _, err := udp.Write([]byte("app.a:1|c\nbad line\nsampled.x:1|ms\ndenied.x:1|c\napp.b:1|c")); err != nil {
+		t.Fatal(err)
+	}
+	// Packet of denied client
+	deniedUDP, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.2")}, s.UDPAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deniedUDP.Close()
+	if _, err := deniedUDP.Write([]byte("app.c:1|c")); err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Dial("tcp", s.TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	// The second line is out of prefixes of client
+	if _, err := tcp.Write([]byte("PROXY TCP4 10.0.0.1 10.0.0.2 40000 8125\r\napp.a:2|c\nother.a:1|c\n")); err != nil {
+		t.Fatal(err)
+	}
+	denied, err := net.Dial("tcp", s.TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.Close()
+	if _, err := denied.Write([]byte("PROXY TCP4 10.0.0.9 10.0.0.2 40000 8125\r\napp.a:4|c\n")); err != nil {
+		t.Fatal(err)
+	}
+	denied.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := denied.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Connection of denied client isn't closed: %v", err)
+	}
+	noProxy, err := net.Dial("tcp", s.TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer noProxy.Close()
+	if _, err := noProxy.Write([]byte("app.a:3|c\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Connection without header is closed by server
+	noProxy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := noProxy.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Connection without PROXY header isn't closed: %v", err)
+	}
+
+	expected := 3
+	if action == CardinalityDrop {
+		expected = 2
+	}
+	testutil.WaitFor(t, "accepted lines", func() bool { return cache.Len() == int64(expected) })
+	testutil.WaitFor(t, "lookups", func() bool {
+		return atomic.LoadInt32(&lookup.lookups) == 2 && !resolver.isResolving("127.0.0.1") && !resolver.isResolving("10.0.0.1")
+	})
+	// Stats are flushed while TCP connection is open
+	var all, unregistered []string
+	for _, v := range []interface{}{s, s.Cardinality, s.Resolver, s.ACL} {
+		fields, notCreated := testutil.MetricFields(v)
+		all = append(all, fields...)
+		unregistered = append(unregistered, notCreated...)
+	}
+	return testutil.StatsValues(t, s.Stats), all, unregistered
+}
+
+func TestMetrics(t *testing.T) {
+	// Cardinality limiter drops or renames lines, so both actions are needed to touch all metrics
+	updated := make(map[string]bool)
+	for _, action := range []string{CardinalityOverflow, CardinalityDrop} {
+		values, declared, unregistered := runMetricsScenario(t, action)
+		if len(unregistered) > 0 {
+			t.Errorf("Metrics are not registered: %v", unregistered)
+		}
+		if len(values) != len(declared) {
+			t.Errorf("%d metrics are flushed, %d are declared: %v", len(values), len(declared), values)
+		}
+		for name, value := range values {
+			updated[name] = updated[name] || value != 0
+		}
+	}
+	for name, ok := range updated {
+		if !ok {
+			t.Errorf("Metric %s is not updated", name)
+		}
+	}
+}
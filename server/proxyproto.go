@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout limits time of waiting for PROXY protocol header of a new connection
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Max length of v1 header including CRLF
+const proxyV1MaxLength = 107
+
+// readProxyHeader reads HAProxy PROXY protocol v1 or v2 header and returns address of the original client.
+// Address is nil for health checks of load balancer (LOCAL command of v2, UNKNOWN of v1) and for not IP clients,
+// connection address should be used then.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		return readProxyV1(r)
+	case proxyV2Signature[0]:
+		return readProxyV2(r)
+	}
+	return nil, errors.New("No PROXY protocol header")
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if err == bufio.ErrBufferFull || len(line) > proxyV1MaxLength {
+		return nil, errors.New("PROXY v1 header is too long")
+	}
+	if !bytes.HasPrefix(line, proxyV1Prefix) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("Bad PROXY v1 header [%q]", line)
+	}
+	fields := strings.Split(string(line[len(proxyV1Prefix):len(line)-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, fmt.Errorf("Bad PROXY v1 header [%q]", line)
+	}
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("Bad PROXY v1 source [%s %s]", fields[1], fields[3])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errors.New("Bad PROXY v2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unknown PROXY protocol version [%d]", header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]>>4
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	switch command {
+	case 0:
+		// LOCAL, connection is made by load balancer itself
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("Unknown PROXY v2 command [%d]", command)
+	}
+	switch {
+	case family == 1 && len(payload) >= 12:
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case family == 2 && len(payload) >= 36:
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	case family == 0 || family == 3:
+		// Unspecified or unix socket address
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Bad PROXY v2 address of family [%d] and length [%d]", family, len(payload))
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+func proxyV2Header(command, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|1, byte(len(payload)>>8), byte(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{10, 1, 2, 3, 10, 0, 0, 1, 0x9c, 0x40, 0x1f, 0xbd}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	v6[32], v6[33] = 0x9c, 0x40
+	tests := []struct {
+		name    string
+		header  []byte
+		client  string
+		invalid bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 10.1.2.3 10.0.0.1 40000 8125\r\n"), "10.1.2.3:40000", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 40000 8125\r\n"), "[2001:db8::1]:40000", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 bad address", []byte("PROXY TCP4 host 10.0.0.1 40000 8125\r\n"), "", true},
+		{"v1 without crlf", []byte("PROXY TCP4 10.1.2.3 10.0.0.1 40000 8125\n"), "", true},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), "", true},
+		{"v2 inet", proxyV2Header(1, 1, v4), "10.1.2.3:40000", false},
+		{"v2 inet6 with tlv", proxyV2Header(1, 2, append(v6, 0x04, 0x00, 0x01, 0x00)), "[2001:db8::1]:40000", false},
+		{"v2 local", proxyV2Header(0, 0, nil), "", false},
+		{"v2 short address", proxyV2Header(1, 1, v4[:8]), "", true},
+		{"v2 bad command", proxyV2Header(2, 1, v4), "", true},
+		{"no header", []byte("app.a:1|c\n"), "", true},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(bytes.NewReader(append(test.header, "app.a:1|c\n"...)))
+		client, err := readProxyHeader(r)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: header is accepted", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if (client == nil && test.client != "") || (client != nil && client.String() != test.client) {
+			t.Errorf("%s: client is [%v], expected [%s]", test.name, client, test.client)
+		}
+		// Lines after header are not touched
+		if line, _ := r.ReadString('\n'); line != "app.a:1|c\n" {
+			t.Errorf("%s: line after header is [%q]", test.name, line)
+		}
+	}
+}
+
+func TestSourceTag(t *testing.T) {
+	for _, test := range []struct {
+		protocol string
+		line     string
+		expected string
+	}{
+		{ProtocolStatsd, "app.a:1|c", "app.a:1|c|#source:10.1.2.3"},
+		{ProtocolStatsd, "app.a:1|c|@0.5|#env:prod", "app.a:1|c|@0.5|#env:prod,source:10.1.2.3"},
+		{ProtocolGraphite, "app.a 1 1500000000", "app.a;source=10.1.2.3 1 1500000000"},
+	} {
+		cache := queue.New(0, 100)
+		s := &Server{
+			ConfigListen:  "127.0.0.1:0",
+			Protocol:      test.protocol,
+			Queue:         cache,
+			Stats:         graphite.New("", nil),
+			ProxyProtocol: true,
+			SourceTag:     "source",
+		}
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", s.TCPAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("PROXY TCP4 10.1.2.3 10.0.0.1 40000 8125\r\n" + test.line + "\n"))
+		testutil.WaitFor(t, "line", func() bool { return cache.Len() == 1 })
+		line, _ := cache.Get()
+		if string(line) != test.expected {
+			t.Errorf("Line is [%s], expected [%s]", line, test.expected)
+		}
+		conn.Close()
+		s.Stop()
+	}
+}
+
+// UDP lines renamed by cardinality limiter get tag too
+func TestSourceTagUDP(t *testing.T) {
+	cache := queue.New(0, 100)
+	s := &Server{
+		ConfigListen: "127.0.0.1:0",
+		Queue:        cache,
+		Stats:        graphite.New("", nil),
+		Cardinality:  &CardinalityLimiter{PrefixDepth: 1, MaxNames: 1, Window: time.Minute, Action: CardinalityOverflow},
+		SourceTag:    "source",
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	conn, err := net.Dial("udp", s.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("app.a:1|c\napp.b:1|c"))
+	testutil.WaitFor(t, "lines", func() bool { return cache.Len() == 2 })
+	for _, expected := range []string{"app.a:1|c|#source:127.0.0.1", "app.overflow:1|c|#source:127.0.0.1"} {
+		line, _ := cache.Get()
+		if string(line) != expected {
+			t.Errorf("Line is [%s], expected [%s]", line, expected)
+		}
+	}
+}
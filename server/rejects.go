@@ -0,0 +1,87 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRejectSources limits count of sources with their own reject counter, others are counted as "other"
+const maxRejectSources = 10000
+
+// Rejected is a line which was rejected by server
+type Rejected struct {
+	Time     time.Time `json:"time"`
+	Listener string    `json:"listener"`
+	Proto    string    `json:"proto"`
+	Source   string    `json:"source"`
+	Line     string    `json:"line"`
+	Reason   string    `json:"reason"`
+}
+
+// RejectLog keeps last rejected lines and counts rejects per source host.
+// It can be shared between servers.
+type RejectLog struct {
+	// time.Now is used if it is nil
+	Now func() time.Time
+
+	mu      sync.Mutex
+	lines   []Rejected
+	next    int
+	full    bool
+	sources map[string]uint64
+}
+
+// NewRejectLog returns RejectLog which keeps size last lines
+func NewRejectLog(size int) *RejectLog {
+	return &RejectLog{
+		lines:   make([]Rejected, size),
+		sources: make(map[string]uint64),
+	}
+}
+
+// add sets time of rejected line and keeps it
+func (r *RejectLog) add(rejected Rejected) {
+	if r.Now != nil {
+		rejected.Time = r.Now()
+	} else {
+		rejected.Time = time.Now()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lines) > 0 {
+		r.lines[r.next] = rejected
+		r.next++
+		if r.next == len(r.lines) {
+			r.next = 0
+			r.full = true
+		}
+	}
+	source := rejected.Source
+	if _, ok := r.sources[source]; !ok && len(r.sources) >= maxRejectSources {
+		source = "other"
+	}
+	r.sources[source]++
+}
+
+// Lines returns rejected lines from the oldest to the newest
+func (r *RejectLog) Lines() []Rejected {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]Rejected(nil), r.lines[:r.next]...)
+	}
+	result := make([]Rejected, 0, len(r.lines))
+	result = append(result, r.lines[r.next:]...)
+	return append(result, r.lines[:r.next]...)
+}
+
+// Sources returns count of rejected lines per source host
+func (r *RejectLog) Sources() map[string]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make(map[string]uint64, len(r.sources))
+	for source, n := range r.sources {
+		result[source] = n
+	}
+	return result
+}
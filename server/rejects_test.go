@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+func TestRejectLog(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	for _, test := range []struct {
+		name    string
+		size    int
+		sources []string
+		// Sources of kept lines from the oldest to the newest
+		expected []string
+	}{
+		{"empty", 3, nil, nil},
+		{"not full", 3, []string{"a", "b"}, []string{"a", "b"}},
+		{"full", 3, []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"wrapped", 3, []string{"a", "b", "c", "d", "e"}, []string{"c", "d", "e"}},
+		{"wrapped twice", 2, []string{"a", "b", "c", "d", "e"}, []string{"d", "e"}},
+		// Lines aren't kept, but sources are counted
+		{"zero size", 0, []string{"a", "a"}, nil},
+	} {
+		r := NewRejectLog(test.size)
+		r.Now = clock
+		counts := make(map[string]uint64)
+		for i, source := range test.sources {
+			now = time.Unix(int64(1000+i), 0)
+			r.add(Rejected{Source: source, Line: fmt.Sprintf("line%d", i)})
+			counts[source]++
+		}
+		var sources []string
+		lines := r.Lines()
+		for i, line := range lines {
+			sources = append(sources, line.Source)
+			// Time is set by log
+			if i > 0 && !line.Time.After(lines[i-1].Time) {
+				t.Errorf("%s: line %d isn't newer than previous one", test.name, i)
+			}
+		}
+		if !reflect.DeepEqual(sources, test.expected) {
+			t.Errorf("%s: lines are from %v, expected %v", test.name, sources, test.expected)
+		}
+		if result := r.Sources(); !reflect.DeepEqual(result, counts) {
+			t.Errorf("%s: sources are %v, expected %v", test.name, result, counts)
+		}
+	}
+}
+
+func TestRejectLogOtherSources(t *testing.T) {
+	r := NewRejectLog(0)
+	for i := 0; i < maxRejectSources+10; i++ {
+		r.add(Rejected{Source: fmt.Sprintf("10.0.%d.%d", i/256, i%256)})
+	}
+	// Known source is still counted by itself
+	r.add(Rejected{Source: "10.0.0.0"})
+	sources := r.Sources()
+	if len(sources) != maxRejectSources+1 || sources["other"] != 10 || sources["10.0.0.0"] != 2 {
+		t.Errorf("%d sources, other %d, known %d", len(sources), sources["other"], sources["10.0.0.0"])
+	}
+}
+
+func TestRejectLogRate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	buf := &bytes.Buffer{}
+	log, err := logger.New(buf, logger.FormatText, logger.Debug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := graphite.New("", nil)
+	s := &Server{
+		Log:           log,
+		Protocol:      ProtocolStatsd,
+		Rejects:       NewRejectLog(100),
+		statsRejected: stats.NewCounter("rejected"),
+		invalidLog:    logger.Limiter{Interval: time.Second, Burst: 2, Now: clock},
+	}
+	s.Rejects.Now = clock
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	reject := func(count int, after time.Duration) {
+		for i := 0; i < count; i++ {
+			s.reject("udp", remote, []byte("bad line"), errors.New("no value"))
+		}
+		now = now.Add(after)
+	}
+	reject(5, time.Second)
+	reject(1, 0)
+
+	// Every line is kept and counted, only log messages are limited
+	if lines := len(s.Rejects.Lines()); lines != 6 {
+		t.Errorf("%d lines are kept, expected 6", lines)
+	}
+	if sources := s.Rejects.Sources(); sources["10.0.0.1"] != 6 {
+		t.Errorf("Sources are %v", sources)
+	}
+	if rejected := testutil.StatsValues(t, stats)["rejected"]; rejected != 6 {
+		t.Errorf("Rejected counter is %v", rejected)
+	}
+	messages := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(messages) != 3 {
+		t.Fatalf("%d messages are written, expected 3:\n%s", len(messages), buf)
+	}
+	if strings.Contains(messages[1], "suppressed") || !strings.Contains(messages[2], "suppressed=3") {
+		t.Errorf("Suppressed count isn't reported once:\n%s", buf)
+	}
+}
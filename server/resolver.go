@@ -0,0 +1,129 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+const (
+	// Max count of reverse DNS lookups in flight, clients which don't fit are resolved later
+	maxLookups    = 16
+	lookupTimeout = 5 * time.Second
+)
+
+// HostResolver returns cached reverse DNS names of clients. Lookups are done in background, so receiving
+// of lines is never blocked by DNS: IP is returned until the name is resolved and when it can't be resolved.
+type HostResolver struct {
+	// How long names and fails are cached
+	TTL time.Duration
+	// Max count of cached clients, the least recently used one is evicted for a new client when cache is full
+	MaxHosts int
+	// net.DefaultResolver.LookupAddr is used if it is nil
+	LookupAddr func(ctx context.Context, addr string) ([]string, error)
+
+	log   *logger.Logger
+	mu    sync.Mutex
+	hosts map[string]*resolvedHost
+	// Hosts from the most recently used to the least one
+	recent  *list.List
+	lookups chan struct{}
+
+	statsLookups    *graphite.Counter
+	statsLookupFail *graphite.Counter
+	statsHosts      *graphite.Gauge
+}
+
+type resolvedHost struct {
+	ip        string
+	name      string
+	expires   time.Time
+	resolving bool
+	element   *list.Element
+}
+
+func (r *HostResolver) start(stats *graphite.Graphite, statsName func(string) string, log *logger.Logger) {
+	r.log = log
+	r.hosts = make(map[string]*resolvedHost)
+	r.recent = list.New()
+	r.lookups = make(chan struct{}, maxLookups)
+	if r.LookupAddr == nil {
+		r.LookupAddr = net.DefaultResolver.LookupAddr
+	}
+	r.statsLookups = stats.NewCounter(statsName("resolver.lookups"))
+	r.statsLookupFail = stats.NewCounter(statsName("resolver.lookupFails"))
+	r.statsHosts = stats.NewGauge(statsName("resolver.hosts"))
+}
+
+// Host returns cached name of ip, starts lookup if ip isn't cached or its name is expired
+func (r *HostResolver) Host(ip string) string {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.hosts[ip]
+	if ok {
+		r.recent.MoveToFront(h.element)
+	}
+	if ok && (h.resolving || now.Before(h.expires)) {
+		return h.name
+	}
+	if !ok {
+		if len(r.hosts) >= r.MaxHosts && !r.evict() {
+			return ip
+		}
+		h = &resolvedHost{ip: ip, name: ip}
+		h.element = r.recent.PushFront(h)
+		r.hosts[ip] = h
+		r.statsHosts.Set(float64(len(r.hosts)))
+	}
+	select {
+	case r.lookups <- struct{}{}:
+	default:
+		return h.name
+	}
+	h.resolving = true
+	go r.lookup(ip, h)
+	return h.name
+}
+
+// evict must be called with locked mu, removes the least recently used host and returns true if it is removed.
+// Host which is being resolved is kept, so new client gets IP until the lookup is done.
+func (r *HostResolver) evict() bool {
+	back := r.recent.Back()
+	if back == nil {
+		return false
+	}
+	h := back.Value.(*resolvedHost)
+	if h.resolving {
+		return false
+	}
+	r.recent.Remove(back)
+	delete(r.hosts, h.ip)
+	return true
+}
+
+func (r *HostResolver) lookup(ip string, h *resolvedHost) {
+	defer func() { <-r.lookups }()
+	r.statsLookups.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	names, err := r.LookupAddr(ctx, ip)
+	cancel()
+	if err != nil || len(names) == 0 {
+		r.statsLookupFail.Add(1)
+		r.log.Debug("Reverse lookup fail", "ip", ip, "error", err)
+	}
+	r.mu.Lock()
+	// The last known name is kept if lookup of expired one fails
+	if err == nil && len(names) > 0 {
+		h.name = strings.TrimSuffix(names[0], ".")
+	}
+	h.expires = time.Now().Add(r.TTL)
+	h.resolving = false
+	r.mu.Unlock()
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+// testLookup resolves names from map, all lookups fail after fail is set.
+// Lookups wait for block to be closed if it isn't nil.
+type testLookup struct {
+	names   map[string]string
+	fail    int32
+	lookups int32
+	block   chan struct{}
+}
+
+func (l *testLookup) lookupAddr(ctx context.Context, addr string) ([]string, error) {
+	atomic.AddInt32(&l.lookups, 1)
+	if l.block != nil {
+		<-l.block
+	}
+	if name, ok := l.names[addr]; ok && atomic.LoadInt32(&l.fail) == 0 {
+		return []string{name + "."}, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func newTestResolver(names map[string]string, ttl time.Duration, maxHosts int) (*HostResolver, *testLookup) {
+	l := &testLookup{names: names}
+	return &HostResolver{TTL: ttl, MaxHosts: maxHosts, LookupAddr: l.lookupAddr}, l
+}
+
+func startTestResolver(r *HostResolver) {
+	r.start(graphite.New("", nil), func(name string) string { return name }, logger.Nop())
+}
+
+func (r *HostResolver) isResolving(ip string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.hosts[ip]
+	return ok && h.resolving
+}
+
+func TestHostResolver(t *testing.T) {
+	r, l := newTestResolver(map[string]string{"10.1.2.3": "web-1.example.com"}, time.Hour, 2)
+	startTestResolver(r)
+
+	// IP is used until name is resolved
+	if host := r.Host("10.1.2.3"); host != "10.1.2.3" && host != "web-1.example.com" {
+		t.Fatalf("Host is [%s]", host)
+	}
+	testutil.WaitFor(t, "resolved name", func() bool { return r.Host("10.1.2.3") == "web-1.example.com" })
+	r.Host("10.9.9.9")
+	testutil.WaitFor(t, "failed lookup", func() bool { return !r.isResolving("10.9.9.9") })
+	if host := r.Host("10.9.9.9"); host != "10.9.9.9" {
+		t.Errorf("Host of not resolved IP is [%s]", host)
+	}
+	// Cached names and fails aren't looked up again
+	if n := atomic.LoadInt32(&l.lookups); n != 2 {
+		t.Errorf("%d lookups, expected 2", n)
+	}
+	// Full cache isn't grown, the least recently used host is evicted for a new one
+	r.Host("10.1.2.3")
+	if host := r.Host("10.5.5.5"); host != "10.5.5.5" || len(r.hosts) != 2 {
+		t.Errorf("Host is [%s], %d hosts are cached", host, len(r.hosts))
+	}
+	r.mu.Lock()
+	_, evicted := r.hosts["10.9.9.9"]
+	_, kept := r.hosts["10.1.2.3"]
+	r.mu.Unlock()
+	if evicted || !kept {
+		t.Errorf("Recently used host is evicted instead of the least recently used one")
+	}
+}
+
+func TestHostResolverEvict(t *testing.T) {
+	r, _ := newTestResolver(nil, time.Hour, 10)
+	startTestResolver(r)
+	for i := 0; i < 100; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		r.Host(ip)
+		testutil.WaitFor(t, "failed lookup", func() bool { return !r.isResolving(ip) })
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.hosts) != 10 || r.recent.Len() != 10 {
+		t.Errorf("%d hosts and %d list elements are cached, expected 10", len(r.hosts), r.recent.Len())
+	}
+	// The last hosts are cached
+	for i := 90; i < 100; i++ {
+		if _, ok := r.hosts[fmt.Sprintf("10.0.%d.%d", i/256, i%256)]; !ok {
+			t.Errorf("Host %d isn't cached", i)
+		}
+	}
+}
+
+func TestHostResolverEvictResolving(t *testing.T) {
+	r, l := newTestResolver(nil, time.Hour, 1)
+	l.block = make(chan struct{})
+	startTestResolver(r)
+	r.Host("10.1.2.3")
+	// Host which is being resolved isn't evicted, new client gets IP
+	if host := r.Host("10.5.5.5"); host != "10.5.5.5" || !r.isResolving("10.1.2.3") || len(r.hosts) != 1 {
+		t.Errorf("Host is [%s], resolving host is evicted", host)
+	}
+	close(l.block)
+	testutil.WaitFor(t, "failed lookup", func() bool { return !r.isResolving("10.1.2.3") })
+	r.Host("10.5.5.5")
+	r.mu.Lock()
+	_, ok := r.hosts["10.5.5.5"]
+	r.mu.Unlock()
+	if !ok {
+		t.Errorf("Resolved host isn't evicted")
+	}
+}
+
+func TestHostResolverExpire(t *testing.T) {
+	ttl := 50 * time.Millisecond
+	r, l := newTestResolver(map[string]string{"10.1.2.3": "web-1.example.com"}, ttl, 1)
+	startTestResolver(r)
+	r.Host("10.1.2.3")
+	testutil.WaitFor(t, "resolved name", func() bool { return r.Host("10.1.2.3") == "web-1.example.com" })
+
+	// The last name is kept when lookup of expired one fails
+	atomic.StoreInt32(&l.fail, 1)
+	testutil.WaitFor(t, "resolve is done", func() bool { return !r.isResolving("10.1.2.3") })
+	lookups := atomic.LoadInt32(&l.lookups)
+	time.Sleep(2 * ttl)
+	r.Host("10.1.2.3")
+	testutil.WaitFor(t, "failed lookup", func() bool { return atomic.LoadInt32(&l.lookups) > lookups && !r.isResolving("10.1.2.3") })
+	if host := r.Host("10.1.2.3"); host != "web-1.example.com" {
+		t.Errorf("Host is [%s] after failed lookup", host)
+	}
+
+	// Expired host is evicted for a new one
+	time.Sleep(2 * ttl)
+	testutil.WaitFor(t, "resolve is done", func() bool { return !r.isResolving("10.1.2.3") })
+	r.Host("10.5.5.5")
+	r.mu.Lock()
+	_, ok := r.hosts["10.5.5.5"]
+	r.mu.Unlock()
+	if !ok {
+		t.Errorf("Expired host isn't evicted")
+	}
+}
+
+func TestSourcePrefix(t *testing.T) {
+	for _, test := range []struct {
+		protocol string
+		line     string
+		expected string
+	}{
+		{ProtocolStatsd, "app.a:1|c", "web-1_example_com.app.a:1|c|#host:web-1.example.com"},
+		{ProtocolGraphite, "app.a 1 1500000000", "web-1_example_com.app.a;host=web-1.example.com 1 1500000000"},
+	} {
+		resolver, _ := newTestResolver(map[string]string{"127.0.0.1": "web-1.example.com"}, time.Hour, 10)
+		cache := queue.New(0, 100)
+		s := &Server{
+			ConfigListen: "127.0.0.1:0",
+			Protocol:     test.protocol,
+			Queue:        cache,
+			Stats:        graphite.New("", nil),
+			SourceTag:    "host",
+			SourcePrefix: true,
+			Resolver:     resolver,
+		}
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("udp", s.UDPAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.WaitFor(t, "prefixed line", func() bool {
+			conn.Write([]byte(test.line))
+			testutil.WaitFor(t, "line", func() bool { return cache.Len() > 0 })
+			line, _ := cache.Get()
+			return string(line) == test.expected
+		})
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func TestSourcePrefixName(t *testing.T) {
+	for host, expected := range map[string]string{
+		"10.1.2.3":          "10_1_2_3.app",
+		"2001:db8::1":       "2001_db8__1.app",
+		"web-1.example.com": "web-1_example_com.app",
+	} {
+		if prefixed := string(sourcePrefix(host, []byte("app"))); prefixed != expected {
+			t.Errorf("Name with host [%s] is [%s], expected [%s]", host, prefixed, expected)
+		}
+	}
+}
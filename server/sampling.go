@@ -0,0 +1,51 @@
+package server
+
+import (
+	"math/rand"
+	"regexp"
+)
+
+// SamplingRule forwards only Rate part of lines with one of Types which names match Pattern.
+// Sample rate of forwarded lines is divided by Rate, so aggregated values stay correct.
+type SamplingRule struct {
+	Pattern *regexp.Regexp
+	Rate    float64
+	// Statsd types of lines for sampling, "ms" and "h" if empty
+	Types []string
+}
+
+var defaultSamplingTypes = []string{"ms", "h"}
+
+func (r *SamplingRule) match(m *statsdLine) bool {
+	types := r.Types
+	if len(types) == 0 {
+		types = defaultSamplingTypes
+	}
+	matched := false
+	for _, t := range types {
+		if string(m.modifier) == t {
+			matched = true
+			break
+		}
+	}
+	return matched && r.Pattern.Match(m.name)
+}
+
+// sample applies the first matched rule to line and returns false if line must be dropped
+func (s *Server) sample(m *statsdLine) bool {
+	for i := range s.Sampling {
+		rule := &s.Sampling[i]
+		if !rule.match(m) {
+			continue
+		}
+		if rule.Rate >= 1 {
+			return true
+		}
+		if rand.Float64() >= rule.Rate {
+			return false
+		}
+		m.setRate(m.rate * rule.Rate)
+		return true
+	}
+	return true
+}
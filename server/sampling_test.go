@@ -0,0 +1,90 @@
+package server
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestParseStatsdRate(t *testing.T) {
+	for _, line := range []string{"a:1|ms|@0", "a:1|ms|@2", "a:1|ms|@-0.5", "a:1|ms|@x", "a:1|ms|@"} {
+		if _, err := parseStatsd([]byte(line)); err == nil {
+			t.Errorf("Line [%s] with bad rate is parsed", line)
+		}
+	}
+	for line, rate := range map[string]float64{"a:1|ms": 1, "a:1|ms|@1": 1, "a:1|ms|@0.5": 0.5, "a:1|c|#t:1|@0.01": 0.01} {
+		m, err := parseStatsd([]byte(line))
+		if err != nil {
+			t.Errorf("Can't parse [%s]: %v", line, err)
+		} else if m.rate != rate {
+			t.Errorf("Rate of [%s] is %v, expected %v", line, m.rate, rate)
+		}
+	}
+}
+
+func TestStatsdLineBytes(t *testing.T) {
+	for _, test := range []struct {
+		line     string
+		change   func(m *statsdLine)
+		expected string
+	}{
+		{"a:1|ms|#t:1|x", func(m *statsdLine) {}, "a:1|ms|#t:1|x"},
+		// Sections stay in their places
+		{"a:1|ms|#t:1|@0.5|x", func(m *statsdLine) { m.setRate(0.25) }, "a:1|ms|#t:1|@0.25|x"},
+		{"a:1|c|#t:1|x", func(m *statsdLine) { m.addTag("s:2") }, "a:1|c|#t:1,s:2|x"},
+		{"a:1|c|x|@0.5|#t:1", func(m *statsdLine) { m.setName([]byte("b")) }, "b:1|c|x|@0.5|#t:1"},
+		// New rate goes right after type, new tags go to the end
+		{"a:1|ms|#t:1|x", func(m *statsdLine) { m.setRate(0.1) }, "a:1|ms|@0.1|#t:1|x"},
+		{"a:1|c|@0.5|x", func(m *statsdLine) { m.addTag("s:2") }, "a:1|c|@0.5|x|#s:2"},
+		// Rate 1 is omitted
+		{"a:1|ms|@0.5|#t:1", func(m *statsdLine) { m.setRate(1) }, "a:1|ms|#t:1"},
+	} {
+		m, err := parseStatsd([]byte(test.line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.change(m)
+		if line := string(m.bytes()); line != test.expected {
+			t.Errorf("Line [%s] is written as [%s], expected [%s]", test.line, line, test.expected)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	s := &Server{Sampling: []SamplingRule{
+		{Pattern: regexp.MustCompile(`^api\.`), Rate: 0.1},
+		{Pattern: regexp.MustCompile(`^web\.`), Rate: 1},
+	}}
+	sample := func(line string) (string, bool) {
+		m, err := parseStatsd([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keep := s.sample(m)
+		return string(m.bytes()), keep
+	}
+
+	// Rate of forwarded lines is multiplied by rate of rule
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		line, keep := sample("api.latency:10|ms|@0.5|#host:a")
+		if !keep {
+			continue
+		}
+		kept++
+		if line != "api.latency:10|ms|@0.05|#host:a" {
+			t.Fatalf("Sampled line is [%s]", line)
+		}
+	}
+	if kept < 800 || kept > 1200 {
+		t.Errorf("%d of 10000 lines are kept with rate 0.1", kept)
+	}
+
+	// Counters aren't sampled by default, unmatched names and rules with rate 1 don't change lines
+	for _, line := range []string{"api.requests:1|c|@0.5", "db.latency:10|ms", "web.latency:10|ms|@0.5"} {
+		for i := 0; i < 100; i++ {
+			if sampled, keep := sample(line); !keep || sampled != line {
+				t.Fatalf("Line [%s] is sampled as [%s] %v", line, sampled, keep)
+			}
+		}
+	}
+}
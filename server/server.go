@@ -3,57 +3,164 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/textproto"
+	"regexp"
 	"strconv"
+	"sync"
 	"time"
+	"unicode"
 
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+	"github.com/AlexAkulov/statsd-ha-proxy/tap"
 	"github.com/go-kit/kit/metrics/graphite"
-	"github.com/op/go-logging"
 )
 
 var (
-	log *logging.Logger
 	EOL = []byte("\n")
 )
 
+const (
+	// ProtocolStatsd accepts statsd lines "name:value|type"
+	ProtocolStatsd = "statsd"
+	// ProtocolGraphite accepts carbon plaintext lines "path value timestamp"
+	ProtocolGraphite = "graphite"
+)
+
 // Server
 type Server struct {
 	ConfigListen  string
 	ConfigServers []string
 	ReadTimeout   time.Duration
+	// ProtocolStatsd or ProtocolGraphite, ProtocolStatsd is used if empty
+	Protocol string
+	// Rules of downsampling of statsd lines, the first matched rule is applied
+	Sampling []SamplingRule
+	// Only metrics which names match one of Allow are accepted if it is set
+	Allow []*regexp.Regexp
+	// Metrics which names match one of Deny are dropped
+	Deny []*regexp.Regexp
+	// Limits count of distinct metric names if it is set
+	Cardinality *CardinalityLimiter
+	// TCP connections must start with HAProxy PROXY protocol v1 or v2 header, client address is taken from it
+	ProxyProtocol bool
+	// Peers which may send PROXY protocol header, like load balancers, connections of other peers are rejected.
+	// Any peer may send it if the list is empty, then ACL checks both the peer and the client from header.
+	ProxyProtocolTrusted []*net.IPNet
+	// Name of tag with host of client which is added to every line if it is set.
+	// Statsd lines get DogStatsD tag "name:host", graphite lines get tag "name=host".
+	SourceTag string
+	// Names of metrics are prefixed with host of client, dots of host are replaced with '_'
+	SourcePrefix bool
+	// Host of client is its IP if Resolver isn't set
+	Resolver *HostResolver
+	// Optional access control list of clients
+	ACL *ACL
 
-	Log             *logging.Logger
+	// Max count of invalid lines logged per second, others are only counted
+	InvalidLinesLogRate int
+	// Optional log of last rejected lines
+	Rejects *RejectLog
+	// Optional tap which gets every accepted line
+	Tap *tap.Tap
+
+	Log             *logger.Logger
 	udpConn         *net.UDPConn
 	tcpListener     *net.TCPListener
-	Channel         chan<- []byte
+	Queue           *queue.Queue
 	Stats           *graphite.Graphite
 	statsTCPBytes   *graphite.Counter
 	statsUDPBytes   *graphite.Counter
 	statsTCPCounter *graphite.Counter
 	statsUDPCounter *graphite.Counter
+	statsSampled    *graphite.Counter
+	statsFiltered   *graphite.Counter
+	statsRejected   *graphite.Counter
+	statsUDPPackets *graphite.Counter
+	statsTCPConns   *graphite.Gauge
+	// Connections closed because of bad PROXY protocol header
+	statsProxyErrors *graphite.Counter
+
+	invalidLog logger.Limiter
+
+	done     chan struct{}
+	wg       sync.WaitGroup
+	connsMu  sync.Mutex
+	tcpConns map[*net.TCPConn]struct{}
 }
 
 // Start server
 func (s *Server) Start() error {
-	log = s.Log
+	if s.Log == nil {
+		s.Log = logger.Nop()
+	}
+	if s.InvalidLinesLogRate == 0 {
+		s.InvalidLinesLogRate = 10
+	}
+	s.invalidLog = logger.Limiter{Interval: time.Second, Burst: s.InvalidLinesLogRate}
+	s.done = make(chan struct{})
+	s.tcpConns = make(map[*net.TCPConn]struct{})
+
+	if s.Protocol == "" {
+		s.Protocol = ProtocolStatsd
+	}
+	s.statsTCPBytes = s.Stats.NewCounter(s.statsName("tcpBytes"))
+	s.statsUDPBytes = s.Stats.NewCounter(s.statsName("udpBytes"))
+	s.statsTCPCounter = s.Stats.NewCounter(s.statsName("tcpCounter"))
+	s.statsUDPCounter = s.Stats.NewCounter(s.statsName("udpCounter"))
+	s.statsSampled = s.Stats.NewCounter(s.statsName("sampledOut"))
+	s.statsFiltered = s.Stats.NewCounter(s.statsName("filtered"))
+	s.statsRejected = s.Stats.NewCounter(s.statsName("rejected"))
+	s.statsUDPPackets = s.Stats.NewCounter(s.statsName("udpPackets"))
+	s.statsTCPConns = s.Stats.NewGauge(s.statsName("tcpConnections"))
+	s.statsProxyErrors = s.Stats.NewCounter(s.statsName("proxyProtocolErrors"))
+	if s.Cardinality != nil {
+		s.Cardinality.start(s.Stats, s.statsName, s.Log)
+	}
+	if s.Resolver != nil {
+		s.Resolver.start(s.Stats, s.statsName, s.Log)
+	}
+	if s.ACL != nil {
+		s.ACL.start(s.Stats, s.statsName)
+	}
 
 	if err := s.startUDP(); err != nil {
 		return err
 	}
 	if err := s.startTCP(); err != nil {
+		s.udpConn.Close()
 		return err
 	}
+	return nil
+}
+
+// statsName keeps names of statsd listener metrics as is and adds protocol to others
+func (s *Server) statsName(name string) string {
+	if s.Protocol == ProtocolStatsd {
+		return "incoming." + name
+	}
+	return "incoming." + s.Protocol + "." + name
+}
 
-	s.statsTCPBytes = s.Stats.NewCounter("incoming.tcpBytes")
-	s.statsUDPBytes = s.Stats.NewCounter("incoming.udpBytes")
-	s.statsTCPCounter = s.Stats.NewCounter("incoming.tcpCounter")
-	s.statsUDPCounter = s.Stats.NewCounter("incoming.udpCounter")
+// UDPAddr returns address of UDP listener
+func (s *Server) UDPAddr() net.Addr {
+	return s.udpConn.LocalAddr()
+}
 
-	return nil
+// TCPAddr returns address of TCP listener
+func (s *Server) TCPAddr() net.Addr {
+	return s.tcpListener.Addr()
+}
+
+// send puts line to Queue, returns false if server is stopped
+func (s *Server) send(line []byte, remote net.Addr) bool {
+	s.Tap.Received(line, remote)
+	return s.Queue.Put(line, s.done)
 }
 
 func (s *Server) startUDP() error {
@@ -68,30 +175,55 @@ func (s *Server) startUDP() error {
 		return err
 	}
 	maxBuf := 4 * 1024
+	s.wg.Add(1)
 	go func() error {
+		defer s.wg.Done()
 		defer s.udpConn.Close()
+		// Queue copies lines, so buffer is reused
+		buf := make([]byte, maxBuf)
 		for {
-			buf := make([]byte, maxBuf)
-			n, _, err := s.udpConn.ReadFromUDP(buf)
+			n, remoteAddr, err := s.udpConn.ReadFromUDP(buf)
 			if err != nil {
-				log.Errorf("UDP Server Error: %v", err)
+				select {
+				case <-s.done:
+					return nil
+				default:
+				}
+				s.Log.Error("UDP server fail", "error", err)
 				return err
 			}
 			if n > 0 {
+				s.statsUDPPackets.Add(1)
+				s.statsUDPBytes.Add(float64(n))
+				var rule *PrefixRule
+				if s.ACL != nil {
+					if !s.ACL.allowed(remoteAddr.IP) {
+						s.ACL.statsRejectedPackets.Add(1)
+						continue
+					}
+					rule = s.ACL.rule(remoteAddr.IP)
+				}
 				lines := bytes.Split(buf[:n], []byte("\n"))
+				source := s.source(remoteAddr)
 				for _, line := range lines {
 					l := bytes.Trim(line, "\r\n\t ")
 					if len(l) < 3 {
 						continue
 					}
-					err := s.validate(l)
+					if !s.allowedLine(rule, l) {
+						continue
+					}
+					processed, err := s.process(l, source)
 					if err != nil {
-						log.Warningf("UDP %v", err)
+						s.reject("udp", remoteAddr, l, err)
+						continue
+					}
+					if processed == nil {
 						continue
 					}
-					// log.Debugf("UDP Received line [%s] bytes", line)
-					s.Channel <- l
-					s.statsUDPBytes.Add(float64(n))
+					if !s.send(processed, remoteAddr) {
+						return nil
+					}
 					s.statsUDPCounter.Add(1)
 				}
 			}
@@ -112,49 +244,123 @@ func (s *Server) startTCP() error {
 		return err
 	}
 
+	s.wg.Add(1)
 	go func() error {
+		defer s.wg.Done()
 		defer s.tcpListener.Close()
 		for {
 			conn, err := s.tcpListener.AcceptTCP()
 			if err != nil {
-				log.Debug("TCP Fail accept with err:", err)
+				select {
+				case <-s.done:
+					return nil
+				default:
+				}
+				s.Log.Debug("TCP accept fail", "error", err)
+				continue
+			}
+			peer := clientIP(conn.RemoteAddr())
+			// Forged header of untrusted peer would bypass ACL
+			if s.ProxyProtocol && len(s.ProxyProtocolTrusted) > 0 && !containsIP(s.ProxyProtocolTrusted, peer) {
+				s.statsProxyErrors.Add(1)
+				s.Log.Debug("TCP connection of untrusted PROXY protocol peer is rejected", "remote", conn.RemoteAddr())
+				conn.Close()
 				continue
 			}
-			log.Debugf("TCP Success accept from %v", conn.RemoteAddr())
+			// Trusted load balancer isn't checked by ACL, its clients are checked after PROXY header
+			if s.ACL != nil && (!s.ProxyProtocol || len(s.ProxyProtocolTrusted) == 0) && !s.ACL.allowed(peer) {
+				s.ACL.statsRejectedConns.Add(1)
+				s.Log.Debug("TCP connection is rejected by ACL", "remote", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			s.Log.Debug("TCP connection is accepted", "remote", conn.RemoteAddr())
+			if !s.trackConn(conn) {
+				conn.Close()
+				return nil
+			}
+			s.wg.Add(1)
 			go s.handleTCP(conn)
 		}
 	}()
 	return nil
 }
 
+// trackConn remembers conn to close it on Stop, returns false if server is stopped
+func (s *Server) trackConn(conn *net.TCPConn) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.tcpConns == nil {
+		return false
+	}
+	s.tcpConns[conn] = struct{}{}
+	return true
+}
+
 func (s *Server) handleTCP(conn *net.TCPConn) error {
-	defer conn.Close()
+	defer s.wg.Done()
+	s.statsTCPConns.Add(1)
+	defer func() {
+		s.connsMu.Lock()
+		delete(s.tcpConns, conn)
+		s.connsMu.Unlock()
+		conn.Close()
+		s.statsTCPConns.Add(-1)
+	}()
 	// conn.SetDeadline(time.Now().Add(s.ReadTimeout))
 	reader := bufio.NewReader(conn)
+	remote := conn.RemoteAddr()
+	if s.ProxyProtocol {
+		conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		client, err := readProxyHeader(reader)
+		if err != nil {
+			s.statsProxyErrors.Add(1)
+			s.Log.Warning("Bad PROXY protocol header", "remote", remote, "error", err)
+			return err
+		}
+		conn.SetReadDeadline(time.Time{})
+		if client != nil {
+			s.Log.Debug("Client address is received by PROXY protocol", "remote", remote, "client", client)
+			remote = client
+		}
+	}
+	var rule *PrefixRule
+	if s.ACL != nil {
+		// Connections from load balancer are checked by address of the original client
+		if s.ProxyProtocol && !s.ACL.allowed(clientIP(remote)) {
+			s.ACL.statsRejectedConns.Add(1)
+			s.Log.Debug("TCP connection is rejected by ACL", "remote", remote)
+			return nil
+		}
+		rule = s.ACL.rule(clientIP(remote))
+	}
 	tp := textproto.NewReader(reader)
 	for {
 		line, err := tp.ReadLineBytes()
 		n := len(line)
 		if err != nil {
 			if err == io.EOF {
-				log.Debugf("TCP Close connection from %v", conn.RemoteAddr())
+				s.Log.Debug("TCP connection is closed", "remote", remote)
 				return nil
 			}
-			log.Debugf("TCP Close connection from %v with err: %v", conn.RemoteAddr(), err)
+			s.Log.Debug("TCP connection is closed", "remote", remote, "error", err)
 			return err
 		}
-		log.Debugf("TCP Received %d bytes from %v", n, conn.RemoteAddr())
-		if n > 0 {
-			go func() {
-				err := s.validate(line)
-				if err != nil {
-					log.Warningf("TCP %v from %v", err, conn.RemoteAddr())
-					return
-				}
-				s.Channel <- line
-				s.statsTCPBytes.Add(float64(n))
-				s.statsTCPCounter.Add(1)
-			}()
+		if n > 0 && s.allowedLine(rule, line) {
+			// Name of client may be resolved while connection is open
+			processed, err := s.process(line, s.source(remote))
+			if err != nil {
+				s.reject("tcp", remote, line, err)
+				continue
+			}
+			if processed == nil {
+				continue
+			}
+			if !s.send(processed, remote) {
+				return nil
+			}
+			s.statsTCPBytes.Add(float64(n))
+			s.statsTCPCounter.Add(1)
 		}
 	}
 }
@@ -165,31 +371,190 @@ func (s *Server) Reload() error {
 	return nil
 }
 
-// Stop server
+// Stop server, closes listeners and client connections and waits for their goroutines
 func (s *Server) Stop() error {
+	close(s.done)
+	s.udpConn.Close()
+	s.tcpListener.Close()
+	s.connsMu.Lock()
+	for conn := range s.tcpConns {
+		conn.Close()
+	}
+	s.tcpConns = nil
+	s.connsMu.Unlock()
+	s.wg.Wait()
 	return nil
 }
 
-func (s *Server) validate(line []byte) error {
-	// Fast validate statsd metrics from heka
-	colonPos := bytes.IndexByte(line, ':')
-	if colonPos == -1 {
-		return fmt.Errorf("Bad line: [%s] Not found ':'", string(line))
+// source returns host of client for SourceTag and SourcePrefix, empty string if both are disabled
+func (s *Server) source(remote net.Addr) string {
+	if s.SourceTag == "" && !s.SourcePrefix {
+		return ""
 	}
-	pipePos := bytes.IndexByte(line, '|')
-	if pipePos == -1 {
-		return fmt.Errorf("Bad line: [%s] Not Found '|'", string(line))
+	host := tap.Host(remote)
+	if s.Resolver != nil {
+		host = s.Resolver.Host(host)
 	}
-	secondPipePos := bytes.IndexByte(line[pipePos+1:], '|')
-	if secondPipePos == -1 {
-		secondPipePos = len(line)
+	return host
+}
+
+// allowedLine checks name of line by prefix rule of client, denied lines are counted
+func (s *Server) allowedLine(rule *PrefixRule, line []byte) bool {
+	if rule == nil {
+		return true
+	}
+	var name []byte
+	if s.Protocol == ProtocolGraphite {
+		name = graphiteName(line)
 	} else {
-		secondPipePos = secondPipePos + pipePos + 1
+		name = line
+		if pos := bytes.IndexByte(line, ':'); pos != -1 {
+			name = line[:pos]
+		}
+	}
+	if rule.allowedName(name) {
+		return true
+	}
+	s.ACL.statsRejectedLines.Add(1)
+	return false
+}
+
+// sourcePrefix returns name prefixed with host, separators of metric name in host are replaced with '_'
+func sourcePrefix(host string, name []byte) []byte {
+	prefixed := make([]byte, 0, len(host)+len(name)+1)
+	for i := 0; i < len(host); i++ {
+		switch c := host[i]; c {
+		case '.', ':', ' ', '|', ';', '=':
+			prefixed = append(prefixed, '_')
+		default:
+			prefixed = append(prefixed, c)
+		}
+	}
+	prefixed = append(prefixed, '.')
+	return append(prefixed, name...)
+}
+
+// process validates line, filters it by name, applies sampling and adds source to name and tags
+// if it isn't empty. It returns line which should be forwarded or nil if line is dropped.
+func (s *Server) process(line []byte, source string) ([]byte, error) {
+	if s.Protocol == ProtocolGraphite {
+		if err := validateGraphite(line); err != nil {
+			return nil, err
+		}
+		// Fields are separated by any whitespace like in validateGraphite
+		line = bytes.TrimSpace(line)
+		name := graphiteName(line)
+		newName := s.filter(name)
+		if newName == nil {
+			return nil, nil
+		}
+		rest := line[len(name):]
+		if source != "" && s.SourcePrefix {
+			newName = sourcePrefix(source, newName)
+		}
+		if source != "" && s.SourceTag != "" {
+			newName = append(newName[:len(newName):len(newName)], ';')
+			newName = append(newName, s.SourceTag...)
+			newName = append(newName, '=')
+			newName = append(newName, source...)
+		}
+		if !bytes.Equal(newName, name) {
+			line = append(newName[:len(newName):len(newName)], rest...)
+		}
+		return line, nil
+	}
+	m, err := parseStatsd(line)
+	if err != nil {
+		return nil, err
+	}
+	newName := s.filter(m.name)
+	if newName == nil {
+		return nil, nil
+	}
+	if !bytes.Equal(newName, m.name) {
+		m.setName(newName)
+	}
+	if len(s.Sampling) > 0 && !s.sample(m) {
+		s.statsSampled.Add(1)
+		return nil, nil
+	}
+	if source != "" && s.SourcePrefix {
+		m.setName(sourcePrefix(source, m.name))
+	}
+	if source != "" && s.SourceTag != "" {
+		m.addTag(s.SourceTag + ":" + source)
+	}
+	return m.bytes(), nil
+}
+
+// filter checks name by allow and deny lists and cardinality limiter.
+// It returns nil if line should be dropped or the name which should be used for line.
+func (s *Server) filter(name []byte) []byte {
+	if len(s.Allow) > 0 && !matchAny(s.Allow, name) {
+		s.statsFiltered.Add(1)
+		return nil
+	}
+	if matchAny(s.Deny, name) {
+		s.statsFiltered.Add(1)
+		return nil
+	}
+	if s.Cardinality != nil {
+		return s.Cardinality.limit(name)
+	}
+	return name
+}
+
+func matchAny(patterns []*regexp.Regexp, name []byte) bool {
+	for _, pattern := range patterns {
+		if pattern.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// reject counts and logs invalid line, messages above InvalidLinesLogRate per second are suppressed
+func (s *Server) reject(proto string, remote net.Addr, line []byte, reason error) {
+	s.statsRejected.Add(1)
+	if s.Rejects != nil {
+		s.Rejects.add(Rejected{
+			Listener: s.Protocol,
+			Proto:    proto,
+			Source:   tap.Host(remote),
+			Line:     string(line),
+			Reason:   reason.Error(),
+		})
+	}
+	ok, suppressed := s.invalidLog.Allow()
+	if !ok {
+		return
+	}
+	keyvals := []interface{}{"proto", proto, "remote", remote, "line", string(line), "reason", reason}
+	if suppressed > 0 {
+		keyvals = append(keyvals, "suppressed", suppressed)
+	}
+	s.Log.Warning("Invalid line", keyvals...)
+}
+
+// graphiteName returns path of graphite line, it is split by the same whitespace as bytes.Fields does
+func graphiteName(line []byte) []byte {
+	line = bytes.TrimLeftFunc(line, unicode.IsSpace)
+	if pos := bytes.IndexFunc(line, unicode.IsSpace); pos != -1 {
+		return line[:pos]
+	}
+	return line
+}
+
+func validateGraphite(line []byte) error {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 {
+		return errors.New("Expected 'path value timestamp'")
+	}
+	if _, err := strconv.ParseFloat(string(fields[1]), 64); err != nil {
+		return fmt.Errorf("Bad value [%s]", string(fields[1]))
 	}
-	modifier := line[pipePos+1 : secondPipePos]
-	lm := len(modifier)
-	if lm != 1 && lm != 2 {
-		return fmt.Errorf("Bad line: [%s] Bad modifier [%s]", string(line), string(modifier))
+	if _, err := strconv.ParseFloat(string(fields[2]), 64); err != nil {
+		return fmt.Errorf("Bad timestamp [%s]", string(fields[2]))
 	}
 	return nil
 }
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+func TestProcessGraphite(t *testing.T) {
+	s := &Server{
+		Protocol: ProtocolGraphite,
+		Deny:     []*regexp.Regexp{regexp.MustCompile(`^denied\.`)},
+	}
+	s.statsFiltered = graphite.New("", nil).NewCounter("filtered")
+	tests := []struct {
+		line     string
+		expected string
+		invalid  bool
+	}{
+		{"app.a 1 1500000000", "app.a 1 1500000000", false},
+		// Any whitespace separates fields, a line like this crashed the server
+		{"app.a\v1\v1500000000", "app.a\v1\v1500000000", false},
+		{"app.a\t1 1500000000", "app.a\t1 1500000000", false},
+		{"  app.a 1 1500000000 ", "app.a 1 1500000000", false},
+		{"denied.a\v1\v1500000000", "", false},
+		{"app.a 1", "", true},
+		{"app.a x 1500000000", "", true},
+	}
+	for _, test := range tests {
+		processed, err := s.process([]byte(test.line), "")
+		if test.invalid {
+			if err == nil {
+				t.Errorf("Line [%q] is accepted", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Line [%q]: %v", test.line, err)
+			continue
+		}
+		if string(processed) != test.expected {
+			t.Errorf("Line [%q] is processed to [%q], expected [%q]", test.line, processed, test.expected)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// statsdLine is a parsed statsd line "name:value|type[|@rate][|#tags]".
+// Fields refer to the original line, unknown sections are kept as is and in their places.
+type statsdLine struct {
+	name     []byte
+	value    []byte
+	modifier []byte
+	rate     float64
+	hasRate  bool
+	tags     []byte
+	// Sections after type, rate and tags are written in place of rateAt and tagsAt, -1 if line has no them
+	sections [][]byte
+	rateAt   int
+	tagsAt   int
+	raw      []byte
+	modified bool
+}
+
+func parseStatsd(line []byte) (*statsdLine, error) {
+	colonPos := bytes.IndexByte(line, ':')
+	if colonPos == -1 {
+		return nil, errors.New("Not found ':'")
+	}
+	sections := bytes.Split(line[colonPos+1:], []byte("|"))
+	if len(sections) < 2 {
+		return nil, errors.New("Not found '|'")
+	}
+	m := &statsdLine{
+		name:     line[:colonPos],
+		value:    sections[0],
+		modifier: sections[1],
+		rate:     1,
+		sections: sections[2:],
+		rateAt:   -1,
+		tagsAt:   -1,
+		raw:      line,
+	}
+	lm := len(m.modifier)
+	if lm != 1 && lm != 2 {
+		return nil, fmt.Errorf("Bad modifier [%s]", string(m.modifier))
+	}
+	for i, section := range m.sections {
+		switch {
+		case len(section) > 0 && section[0] == '@':
+			rate, err := strconv.ParseFloat(string(section[1:]), 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("Bad sample rate [%s]", string(section))
+			}
+			m.rate = rate
+			m.hasRate = true
+			m.rateAt = i
+		case len(section) > 0 && section[0] == '#':
+			m.tags = section[1:]
+			m.tagsAt = i
+		}
+	}
+	return m, nil
+}
+
+// setName changes name of line
+func (m *statsdLine) setName(name []byte) {
+	m.name = name
+	m.modified = true
+}
+
+// setRate changes sample rate of line
+func (m *statsdLine) setRate(rate float64) {
+	m.rate = rate
+	m.hasRate = rate < 1
+	m.modified = true
+}
+
+// addTag appends DogStatsD tag "name:value" to tags of line
+func (m *statsdLine) addTag(tag string) {
+	tags := make([]byte, 0, len(m.tags)+len(tag)+1)
+	tags = append(tags, m.tags...)
+	if len(tags) > 0 {
+		tags = append(tags, ',')
+	}
+	m.tags = append(tags, tag...)
+	m.modified = true
+}
+
+// bytes returns line in statsd format, the original line is returned if nothing is changed.
+// Order of sections is kept, a new rate goes right after type and new tags go to the end.
+func (m *statsdLine) bytes() []byte {
+	if !m.modified {
+		return m.raw
+	}
+	buf := make([]byte, 0, len(m.raw)+16)
+	buf = append(buf, m.name...)
+	buf = append(buf, ':')
+	buf = append(buf, m.value...)
+	buf = append(buf, '|')
+	buf = append(buf, m.modifier...)
+	if m.rateAt == -1 {
+		buf = m.appendRate(buf)
+	}
+	for i, section := range m.sections {
+		switch i {
+		case m.rateAt:
+			buf = m.appendRate(buf)
+		case m.tagsAt:
+			buf = m.appendTags(buf)
+		default:
+			buf = append(buf, '|')
+			buf = append(buf, section...)
+		}
+	}
+	if m.tagsAt == -1 {
+		buf = m.appendTags(buf)
+	}
+	return buf
+}
+
+func (m *statsdLine) appendRate(buf []byte) []byte {
+	if !m.hasRate {
+		return buf
+	}
+	buf = append(buf, "|@"...)
+	return strconv.AppendFloat(buf, m.rate, 'g', -1, 64)
+}
+
+func (m *statsdLine) appendTags(buf []byte) []byte {
+	if len(m.tags) == 0 {
+		return buf
+	}
+	buf = append(buf, "|#"...)
+	return append(buf, m.tags...)
+}
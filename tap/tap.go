@@ -0,0 +1,121 @@
+// Package tap lets to watch lines passing through the proxy without slowing it down
+package tap
+
+import (
+	"net"
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+// Filter of lines. Lines are matched by Source when they are received by server
+// and by Backend when they are written to backend, so Source and Backend can't be used together.
+type Filter struct {
+	Pattern *regexp.Regexp
+	// Host of client without port
+	Source string
+	// Address of backend as in servers list
+	Backend string
+}
+
+// Subscriber gets matched lines from C. Lines are dropped when C is full.
+type Subscriber struct {
+	C       chan []byte
+	filter  Filter
+	dropped uint64
+}
+
+// Dropped returns count of lines which were dropped because subscriber is slow
+func (s *Subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscriber) send(line []byte) {
+	select {
+	case s.C <- line:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Tap delivers lines to subscribers. Nil Tap has no subscribers.
+type Tap struct {
+	count int32
+	mu    sync.RWMutex
+	subs  map[*Subscriber]struct{}
+}
+
+// Subscribe returns subscriber with a queue of size lines
+func (t *Tap) Subscribe(filter Filter, size int) *Subscriber {
+	s := &Subscriber{C: make(chan []byte, size), filter: filter}
+	t.mu.Lock()
+	if t.subs == nil {
+		t.subs = make(map[*Subscriber]struct{})
+	}
+	t.subs[s] = struct{}{}
+	atomic.StoreInt32(&t.count, int32(len(t.subs)))
+	t.mu.Unlock()
+	return s
+}
+
+// Unsubscribe stops delivering lines to s
+func (t *Tap) Unsubscribe(s *Subscriber) {
+	t.mu.Lock()
+	delete(t.subs, s)
+	atomic.StoreInt32(&t.count, int32(len(t.subs)))
+	t.mu.Unlock()
+}
+
+func (t *Tap) active() bool {
+	return t != nil && atomic.LoadInt32(&t.count) > 0
+}
+
+// Received is called by server for every accepted line
+func (t *Tap) Received(line []byte, addr net.Addr) {
+	if !t.active() {
+		return
+	}
+	source := Host(addr)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for s := range t.subs {
+		if s.filter.Backend != "" || (s.filter.Source != "" && s.filter.Source != source) {
+			continue
+		}
+		if s.filter.Pattern != nil && !s.filter.Pattern.Match(line) {
+			continue
+		}
+		// Buffer of received line is reused by server
+		s.send(append([]byte(nil), line...))
+	}
+}
+
+// Sent is called by upstream for every line written to backend
+func (t *Tap) Sent(line []byte, backend string) {
+	if !t.active() {
+		return
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for s := range t.subs {
+		if s.filter.Backend == "" || s.filter.Backend != backend {
+			continue
+		}
+		if s.filter.Pattern != nil && !s.filter.Pattern.Match(line) {
+			continue
+		}
+		s.send(line)
+	}
+}
+
+// Host returns host of addr without port, so all sockets of a client are the same source
+func Host(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,109 @@
+package tap
+
+import (
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+// lines returns lines queued for subscriber
+func lines(s *Subscriber) []string {
+	var result []string
+	for {
+		select {
+		case line := <-s.C:
+			result = append(result, string(line))
+		default:
+			sort.Strings(result)
+			return result
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tap := &Tap{}
+	clientA := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	clientB := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40001}
+	for _, test := range []struct {
+		name     string
+		filter   Filter
+		expected []string
+	}{
+		{"all received", Filter{}, []string{"app.a:1|c", "app.b:1|c", "web.a:1|c"}},
+		{"pattern", Filter{Pattern: regexp.MustCompile(`^app\.`)}, []string{"app.a:1|c", "app.b:1|c"}},
+		// All sockets of client are one source
+		{"source", Filter{Source: "10.0.0.1"}, []string{"app.a:1|c", "web.a:1|c"}},
+		{"source and pattern", Filter{Source: "10.0.0.1", Pattern: regexp.MustCompile(`^web\.`)}, []string{"web.a:1|c"}},
+		{"backend", Filter{Backend: "statsite1:8125"}, []string{"app.a:1|c", "web.a:1|c"}},
+		{"backend and pattern", Filter{Backend: "statsite2:8125", Pattern: regexp.MustCompile(`^web\.`)}, nil},
+	} {
+		s := tap.Subscribe(test.filter, 100)
+		tap.Received([]byte("app.a:1|c"), clientA)
+		tap.Received([]byte("app.b:1|c"), clientB)
+		tap.Received([]byte("web.a:1|c"), &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40002})
+		tap.Sent([]byte("app.a:1|c"), "statsite1:8125")
+		tap.Sent([]byte("web.a:1|c"), "statsite1:8125")
+		tap.Sent([]byte("app.b:1|c"), "statsite2:8125")
+		tap.Unsubscribe(s)
+		if result := lines(s); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("%s: subscriber got %v, expected %v", test.name, result, test.expected)
+		}
+	}
+}
+
+func TestReceivedLineIsCopied(t *testing.T) {
+	tap := &Tap{}
+	s := tap.Subscribe(Filter{}, 10)
+	buf := []byte("app.a:1|c")
+	tap.Received(buf, nil)
+	copy(buf, "xxx")
+	if line := string(<-s.C); line != "app.a:1|c" {
+		t.Errorf("Line is changed to [%s]", line)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	tap := &Tap{}
+	slow := tap.Subscribe(Filter{}, 2)
+	fast := tap.Subscribe(Filter{}, 10)
+	for i := 0; i < 5; i++ {
+		tap.Received([]byte("app.a:1|c"), nil)
+	}
+	// Full queue of one subscriber doesn't block the others
+	if len(slow.C) != 2 || slow.Dropped() != 3 {
+		t.Errorf("Slow subscriber has %d lines and %d dropped, expected 2 and 3", len(slow.C), slow.Dropped())
+	}
+	if len(fast.C) != 5 || fast.Dropped() != 0 {
+		t.Errorf("Fast subscriber has %d lines and %d dropped, expected 5 and 0", len(fast.C), fast.Dropped())
+	}
+
+	// Unsubscribed one gets nothing
+	tap.Unsubscribe(slow)
+	tap.Unsubscribe(fast)
+	lines(fast)
+	tap.Received([]byte("app.a:1|c"), nil)
+	if len(fast.C) != 0 || tap.active() {
+		t.Error("Line is delivered after unsubscribe")
+	}
+}
+
+func TestNilTap(t *testing.T) {
+	var tap *Tap
+	tap.Received([]byte("app.a:1|c"), nil)
+	tap.Sent([]byte("app.a:1|c"), "statsite1:8125")
+}
+
+func TestHost(t *testing.T) {
+	for addr, expected := range map[net.Addr]string{
+		&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}: "10.0.0.1",
+		&net.TCPAddr{IP: net.ParseIP("::1"), Port: 40000}:      "::1",
+		&net.UnixAddr{Name: "/tmp/statsd.sock", Net: "unix"}:   "/tmp/statsd.sock",
+		nil: "",
+	} {
+		if host := Host(addr); host != expected {
+			t.Errorf("Host of %v is [%s], expected [%s]", addr, host, expected)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package upstreams
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+// backend is one statsd server. It owns one or more connections (streams), every one has its own queue
+// and writer goroutine. Lines which can't be written are given back to the dispatcher of upstream.
+type backend struct {
+	// 1 when backend gets traffic
+	statsActive *graphite.Gauge
+	// Count of connected streams
+	statsConnected     *graphite.Gauge
+	statsSentBytes     *graphite.Counter
+	statsSentLines     *graphite.Counter
+	statsReconnects    *graphite.Counter
+	statsConnectErrors *graphite.Counter
+	statsWriteErrors   *graphite.Counter
+	// Lines which were written partially before write error, they may be duplicated
+	statsPartialWrites *graphite.Counter
+	// 1 when backend is too slow to get traffic
+	statsDegraded *graphite.Gauge
+	// Histograms of go-kit aren't reset by flush, so percentiles are for the whole lifetime of backend
+	statsWriteLatency *graphite.Histogram
+	// Metrics of backend are kept apart from Stats of upstream, so they are forgotten with the backend
+	stats *graphite.Graphite
+
+	server   string
+	weight   int
+	timeout  time.Duration
+	streams  []*stream
+	upstream *Upstream
+
+	// Count of connected streams, read by dispatcher without locking
+	connected int32
+	// Unix time when the first stream was connected and when the last one was disconnected
+	uptime   int64
+	downtime int64
+	// Write latency in nanoseconds averaged over the last writes of all streams
+	latency int64
+	// Unix time in nanoseconds when backend was slow last time
+	slowAt int64
+	// Unix time in nanoseconds when queue was filled more than DegradedQueue part last time
+	queueFullAt int64
+	// Degradation reported by watchdog
+	degradedReported bool
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newBackend(u *Upstream, server BackendConfig) *backend {
+	stats := graphite.New(u.StatsPrefix, nil)
+	b := &backend{
+		statsActive:        stats.NewGauge(backendStatsName(server.Server, "active")),
+		statsConnected:     stats.NewGauge(backendStatsName(server.Server, "connected")),
+		statsSentBytes:     stats.NewCounter(backendStatsName(server.Server, "sendBytes")),
+		statsSentLines:     stats.NewCounter(backendStatsName(server.Server, "sendLines")),
+		statsReconnects:    stats.NewCounter(backendStatsName(server.Server, "reconnects")),
+		statsConnectErrors: stats.NewCounter(backendStatsName(server.Server, "connectErrors")),
+		statsWriteErrors:   stats.NewCounter(backendStatsName(server.Server, "writeErrors")),
+		statsPartialWrites: stats.NewCounter(backendStatsName(server.Server, "partialWrites")),
+		statsDegraded:      stats.NewGauge(backendStatsName(server.Server, "degraded")),
+		statsWriteLatency:  stats.NewHistogram(backendStatsName(server.Server, "writeLatencyMs"), 50),
+		stats:              stats,
+		server:             server.Server,
+		weight:             server.Weight,
+		timeout:            u.BackendTimeout,
+		upstream:           u,
+		downtime:           time.Now().Unix(),
+		uptime:             time.Now().Unix(),
+		done:               make(chan struct{}),
+	}
+	b.streams = make([]*stream, server.connections())
+	for i := range b.streams {
+		b.streams[i] = newStream(b, i)
+	}
+	return b
+}
+
+// start runs writer goroutine of every stream
+func (b *backend) start() {
+	for _, s := range b.streams {
+		b.upstream.wg.Add(1)
+		go s.run()
+	}
+}
+
+// isAlive returns true if at least one stream is connected
+func (b *backend) isAlive() bool {
+	return atomic.LoadInt32(&b.connected) > 0
+}
+
+func (b *backend) streamIsUp() {
+	connected := atomic.AddInt32(&b.connected, 1)
+	if connected == 1 {
+		atomic.StoreInt64(&b.uptime, time.Now().Unix())
+	}
+	b.statsConnected.Set(float64(connected))
+}
+
+func (b *backend) streamIsDown() {
+	connected := atomic.AddInt32(&b.connected, -1)
+	if connected == 0 {
+		atomic.StoreInt64(&b.downtime, time.Now().Unix())
+	}
+	b.statsConnected.Set(float64(connected))
+}
+
+var (
+	// errRetryLater is returned by Connect while backend waits for its next retry
+	errRetryLater = errors.New("retry later")
+	errStopped    = errors.New("backend is stopped")
+)
+
+// Connect dials streams which aren't connected. Returns nil if at least one stream is connected,
+// errRetryLater if all of them wait for the next retry and the last dial error otherwise.
+// Fails of some streams of alive backend are only logged.
+func (b *backend) Connect() error {
+	var (
+		result error = errRetryLater
+		failed []*stream
+	)
+	for _, s := range b.streams {
+		switch err := s.Connect(); err {
+		case nil, errRetryLater:
+		case errStopped:
+			return err
+		default:
+			result = err
+			failed = append(failed, s)
+		}
+	}
+	if !b.isAlive() {
+		return result
+	}
+	for _, s := range failed {
+		b.upstream.Log.Debug("Reconnect fail", "backend", b.server, "connection", s.index, "error", s.state().LastError,
+			"retry_in", time.Until(s.retryAt()).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// put queues line without blocking to the stream chosen by metric name, the next alive stream is used
+// if that one is down. Returns false if the chosen queue is full, lines of a metric aren't reordered then.
+func (b *backend) put(line []byte) bool {
+	n := uint32(len(b.streams))
+	var i uint32
+	if n > 1 {
+		// FNV-1a inline, it doesn't allocate
+		h := uint32(2166136261)
+		for _, c := range metricName(line) {
+			h ^= uint32(c)
+			h *= 16777619
+		}
+		i = h % n
+	}
+	for j := uint32(0); j < n; j++ {
+		s := b.streams[(i+j)%n]
+		if !s.isAlive() {
+			continue
+		}
+		select {
+		case s.queue <- line:
+			return true
+		default:
+			if b.upstream.DegradedQueue > 0 {
+				atomic.StoreInt64(&b.queueFullAt, time.Now().UnixNano())
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// queued returns count of lines in queues of all streams and their capacity
+func (b *backend) queued() (queued int, capacity int) {
+	for _, s := range b.streams {
+		queued += len(s.queue)
+		capacity += cap(s.queue)
+	}
+	return queued, capacity
+}
+
+// backoff returns delay before the next connect after failures. Delay is doubled after every fail up to max
+// and is randomized in [delay/2, delay], so backends which failed together don't reconnect in lockstep.
+func backoff(base, max time.Duration, failures int) time.Duration {
+	if max < base {
+		max = base
+	}
+	delay := base
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// BackendState is state of backend for troubleshooting
+type BackendState struct {
+	Server   string `json:"server"`
+	Weight   int    `json:"weight"`
+	Alive    bool   `json:"alive"`
+	Active   bool   `json:"active"`
+	Queued   int    `json:"queued"`
+	Degraded bool   `json:"degraded"`
+	// Average write latency in milliseconds
+	Latency float64 `json:"latency_ms"`
+	// The most of fails of streams and the last error of that stream
+	Failures  int        `json:"failures"`
+	LastError string     `json:"last_error,omitempty"`
+	NextRetry *time.Time `json:"next_retry,omitempty"`
+	Uptime    time.Time  `json:"uptime"`
+	Downtime  time.Time  `json:"downtime"`
+	// State of every stream if backend has more than one
+	Connections []ConnectionState `json:"connections,omitempty"`
+}
+
+func (b *backend) state() BackendState {
+	state := BackendState{
+		Server:   b.server,
+		Alive:    b.isAlive(),
+		Degraded: b.degradation(time.Now()) != degradedNone,
+		Latency:  float64(b.averageLatency()) / float64(time.Millisecond),
+		Uptime:   time.Unix(atomic.LoadInt64(&b.uptime), 0),
+		Downtime: time.Unix(atomic.LoadInt64(&b.downtime), 0),
+	}
+	for _, s := range b.streams {
+		connection := s.state()
+		state.Queued += connection.Queued
+		if connection.Failures > state.Failures {
+			state.Failures = connection.Failures
+			state.LastError = connection.LastError
+		}
+		if connection.NextRetry != nil && (state.NextRetry == nil || connection.NextRetry.Before(*state.NextRetry)) {
+			state.NextRetry = connection.NextRetry
+		}
+		if len(b.streams) > 1 {
+			state.Connections = append(state.Connections, connection)
+		}
+	}
+	return state
+}
+
+// retryAt returns time of the earliest connect of streams which are down, zero time if all streams are connected
+func (b *backend) retryAt() time.Time {
+	var retryAt time.Time
+	for _, s := range b.streams {
+		if t := s.retryAt(); !t.IsZero() && (retryAt.IsZero() || t.Before(retryAt)) {
+			retryAt = t
+		}
+	}
+	return retryAt
+}
+
+// observeLatency updates average write latency, backend is slow if it is greater than DegradedLatency
+func (b *backend) observeLatency(latency time.Duration) {
+	b.statsWriteLatency.Observe(float64(latency) / float64(time.Millisecond))
+	// Writers of all streams update it
+	var average int64
+	for {
+		old := atomic.LoadInt64(&b.latency)
+		average = old + (int64(latency)-old)/8
+		if atomic.CompareAndSwapInt64(&b.latency, old, average) {
+			break
+		}
+	}
+	if b.upstream.DegradedLatency > 0 && time.Duration(average) > b.upstream.DegradedLatency {
+		atomic.StoreInt64(&b.slowAt, time.Now().UnixNano())
+	}
+}
+
+func (b *backend) averageLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.latency))
+}
+
+// Levels of degradation, backends with lower level are preferred
+const (
+	degradedNone = iota
+	// Queue was filled more than DegradedQueue part during the last SwitchLatency,
+	// it happens to healthy backends under load too
+	degradedQueue
+	// Average write latency was greater than DegradedLatency or write timed out during the last SwitchLatency.
+	// Slow backend gets traffic again after that time, so it is probed with real lines.
+	degradedSlow
+)
+
+func (b *backend) degradation(now time.Time) int {
+	u := b.upstream
+	if u.DegradedLatency > 0 {
+		slowAt := atomic.LoadInt64(&b.slowAt)
+		if slowAt != 0 && now.UnixNano()-slowAt < int64(u.SwitchLatency) {
+			return degradedSlow
+		}
+	}
+	if u.DegradedQueue > 0 {
+		// Level is kept for SwitchLatency, so traffic isn't switched back and forth while queue is about the limit
+		if queued, capacity := b.queued(); float64(queued) >= u.DegradedQueue*float64(capacity) {
+			atomic.StoreInt64(&b.queueFullAt, now.UnixNano())
+			return degradedQueue
+		}
+		fullAt := atomic.LoadInt64(&b.queueFullAt)
+		if fullAt != 0 && now.UnixNano()-fullAt < int64(u.SwitchLatency) {
+			return degradedQueue
+		}
+	}
+	return degradedNone
+}
+
+// Stop makes writer goroutines to flush queues and exit. Backend must be removed from dispatching before Stop.
+func (b *backend) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.done)
+	})
+}
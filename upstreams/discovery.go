@@ -0,0 +1,175 @@
+package upstreams
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// DiscoveryA expands host:port server to backends with every A/AAAA record of host
+	DiscoveryA = "a"
+	// DiscoverySRV expands SRV record name to backends with target:port of every record.
+	// Records with lower priority value go first, SRV weight is used as backend weight if it is not zero.
+	DiscoverySRV = "srv"
+)
+
+func lookupSRV(name string) ([]*net.SRV, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	return records, err
+}
+
+// resolve expands server to list of backends
+func (u *Upstream) resolve(server BackendConfig) ([]BackendConfig, error) {
+	switch server.Discovery {
+	case "":
+		return []BackendConfig{server}, nil
+	case DiscoveryA:
+		host, port, err := net.SplitHostPort(server.Server)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := u.LookupHost(host)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(addrs)
+		result := make([]BackendConfig, len(addrs))
+		for i, addr := range addrs {
+			result[i] = BackendConfig{Server: net.JoinHostPort(addr, port), Weight: server.Weight, Connections: server.Connections}
+		}
+		return result, nil
+	case DiscoverySRV:
+		records, err := u.LookupSRV(server.Server)
+		if err != nil {
+			return nil, err
+		}
+		// LookupSRV randomizes records with the same priority, keep order stable
+		sort.Slice(records, func(i, j int) bool {
+			if records[i].Priority != records[j].Priority {
+				return records[i].Priority < records[j].Priority
+			}
+			if records[i].Target != records[j].Target {
+				return records[i].Target < records[j].Target
+			}
+			return records[i].Port < records[j].Port
+		})
+		result := make([]BackendConfig, len(records))
+		for i, r := range records {
+			weight := server.Weight
+			if r.Weight > 0 {
+				weight = int(r.Weight)
+			}
+			target := strings.TrimSuffix(r.Target, ".")
+			result[i] = BackendConfig{Server: net.JoinHostPort(target, strconv.Itoa(int(r.Port))), Weight: weight, Connections: server.Connections}
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("unknown discovery type [%s]", server.Discovery)
+}
+
+// resolveBackends expands BackendsList. If a server can't be resolved the last known result is used for it.
+// Results of servers which aren't in BackendsList anymore are forgotten.
+func (u *Upstream) resolveBackends() []BackendConfig {
+	var result []BackendConfig
+	seen := make(map[string]bool)
+	resolved := make(map[BackendConfig][]BackendConfig, len(u.BackendsList))
+	for _, server := range u.BackendsList {
+		backends, err := u.resolve(server)
+		if err != nil {
+			u.Log.Error("Resolve fail", "server", server.Server, "discovery", server.Discovery, "error", err)
+			backends = u.resolved[server]
+		}
+		if backends != nil {
+			resolved[server] = backends
+		}
+		for _, b := range backends {
+			if seen[b.Server] {
+				continue
+			}
+			seen[b.Server] = true
+			result = append(result, b)
+		}
+	}
+	u.resolved = resolved
+	return result
+}
+
+func (u *Upstream) hasDiscovery() bool {
+	for _, server := range u.BackendsList {
+		if server.Discovery != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadBackendsFile replaces BackendsList with servers from BackendsFile if the file was changed since last load
+func (u *Upstream) loadBackendsFile() (bool, error) {
+	info, err := os.Stat(u.BackendsFile)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(u.backendsFileModTime) && info.Size() == u.backendsFileSize {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(u.BackendsFile)
+	if err != nil {
+		return false, err
+	}
+	var list []BackendConfig
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return false, err
+	}
+	if err := CheckBackendsList(list, u.Mode); err != nil {
+		return false, err
+	}
+	u.BackendsList = list
+	u.backendsFileModTime = info.ModTime()
+	u.backendsFileSize = info.Size()
+	return true, nil
+}
+
+// discovery applies changes of DNS records and servers file to backends
+func (u *Upstream) discovery() {
+	defer u.wg.Done()
+	var dnsTicker, fileTicker <-chan time.Time
+	if u.DiscoveryInterval > 0 {
+		ticker := time.NewTicker(u.DiscoveryInterval)
+		defer ticker.Stop()
+		dnsTicker = ticker.C
+	}
+	if u.BackendsFile != "" && u.BackendsFileInterval > 0 {
+		ticker := time.NewTicker(u.BackendsFileInterval)
+		defer ticker.Stop()
+		fileTicker = ticker.C
+	}
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-dnsTicker:
+			if !u.hasDiscovery() {
+				continue
+			}
+		case <-fileTicker:
+			changed, err := u.loadBackendsFile()
+			if err != nil {
+				u.Log.Error("Load servers fail", "file", u.BackendsFile, "error", err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			u.Log.Info("Servers list is reloaded", "file", u.BackendsFile)
+		}
+		u.setBackends(u.resolveBackends())
+	}
+}
@@ -0,0 +1,191 @@
+package upstreams
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"gopkg.in/yaml.v2"
+)
+
+// testDNS is a stub resolver, names which aren't in maps fail
+type testDNS struct {
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+}
+
+func (d *testDNS) lookupHost(host string) ([]string, error) {
+	if addrs, ok := d.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (d *testDNS) lookupSRV(name string) ([]*net.SRV, error) {
+	if records, ok := d.srv[name]; ok {
+		return records, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func newDiscoveryUpstream(dns *testDNS, servers ...BackendConfig) *Upstream {
+	return &Upstream{
+		Log:          logger.Nop(),
+		BackendsList: servers,
+		LookupHost:   dns.lookupHost,
+		LookupSRV:    dns.lookupSRV,
+		resolved:     make(map[BackendConfig][]BackendConfig),
+	}
+}
+
+func TestResolveBackends(t *testing.T) {
+	dns := &testDNS{
+		hosts: map[string][]string{"statsd.local": {"10.0.0.2", "10.0.0.1", "::1"}},
+		srv: map[string][]*net.SRV{"_statsd._udp.local": {
+			{Target: "c.local.", Port: 8127, Priority: 20, Weight: 0},
+			{Target: "b.local.", Port: 8126, Priority: 10, Weight: 5},
+			{Target: "a.local.", Port: 8126, Priority: 10, Weight: 0},
+			// Duplicate of A record is skipped
+			{Target: "10.0.0.1.", Port: 8125, Priority: 30},
+		}},
+	}
+	u := newDiscoveryUpstream(dns,
+		BackendConfig{Server: "statsd.local:8125", Discovery: DiscoveryA, Weight: 2, Connections: 3},
+		BackendConfig{Server: "_statsd._udp.local", Discovery: DiscoverySRV, Weight: 1},
+		BackendConfig{Server: "static:8125", Weight: 1},
+	)
+	expected := []BackendConfig{
+		// Addresses are sorted, weight and connections are taken from server
+		{Server: "10.0.0.1:8125", Weight: 2, Connections: 3},
+		{Server: "10.0.0.2:8125", Weight: 2, Connections: 3},
+		{Server: "[::1]:8125", Weight: 2, Connections: 3},
+		// Records are sorted by priority, then by target, non-zero SRV weight is used
+		{Server: "a.local:8126", Weight: 1},
+		{Server: "b.local:8126", Weight: 5},
+		{Server: "c.local:8127", Weight: 1},
+		{Server: "static:8125", Weight: 1},
+	}
+	if result := u.resolveBackends(); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Backends are %v, expected %v", result, expected)
+	}
+
+	// The last known result is used when resolve fails
+	dns.hosts = nil
+	dns.srv = nil
+	if result := u.resolveBackends(); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Backends after resolve fail are %v, expected %v", result, expected)
+	}
+
+	// Server which never resolved gives no backends
+	u.BackendsList = append(u.BackendsList, BackendConfig{Server: "unknown.local:8125", Discovery: DiscoveryA})
+	if result := u.resolveBackends(); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Backends with unresolved server are %v, expected %v", result, expected)
+	}
+}
+
+func TestResolvedPruned(t *testing.T) {
+	dns := &testDNS{hosts: map[string][]string{"a.local": {"10.0.0.1"}, "b.local": {"10.0.0.2"}}}
+	a := BackendConfig{Server: "a.local:8125", Discovery: DiscoveryA}
+	b := BackendConfig{Server: "b.local:8125", Discovery: DiscoveryA}
+	u := newDiscoveryUpstream(dns, a, b)
+	u.resolveBackends()
+	if len(u.resolved) != 2 {
+		t.Fatalf("Resolved servers are %v", u.resolved)
+	}
+
+	// Server removed from list is forgotten, so it doesn't come back when it fails later
+	u.BackendsList = []BackendConfig{a}
+	u.resolveBackends()
+	if _, ok := u.resolved[b]; ok || len(u.resolved) != 1 {
+		t.Errorf("Resolved servers after remove are %v", u.resolved)
+	}
+	delete(dns.hosts, "b.local")
+	u.BackendsList = []BackendConfig{a, b}
+	expected := []BackendConfig{{Server: "10.0.0.1:8125"}}
+	if result := u.resolveBackends(); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Backends are %v, expected %v", result, expected)
+	}
+}
+
+func TestBackendsFileReload(t *testing.T) {
+	first := testutil.NewSink(t, "127.0.0.1:0")
+	defer first.Kill()
+	second := testutil.NewSink(t, "127.0.0.1:0")
+	defer second.Kill()
+	dir, err := ioutil.TempDir("", "statsd-ha-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "servers.yml")
+	// Lists differ in size, so change is seen even if modification time is the same
+	writeServers := func(servers ...string) {
+		data, err := yaml.Marshal(servers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeServers(first.Addr)
+
+	// Servers of config are replaced by servers of file
+	u, cache := newTestUpstream(ModeWeighted, "127.0.0.1:1")
+	u.BackendsFile = path
+	u.BackendsFileInterval = 10 * time.Millisecond
+	activeServers := func() []string {
+		var servers []string
+		for _, state := range u.Backends() {
+			if state.Active {
+				servers = append(servers, state.Server)
+			}
+		}
+		return servers
+	}
+	u.Start()
+	defer u.Stop()
+	testutil.WaitFor(t, "first backend", func() bool { return reflect.DeepEqual(activeServers(), []string{first.Addr}) })
+	sendLines(cache, 0, 100)
+	testutil.WaitFor(t, "lines on first", func() bool { return first.Count() == 100 })
+
+	writeServers(first.Addr, second.Addr)
+	testutil.WaitFor(t, "both backends", func() bool { return reflect.DeepEqual(activeServers(), []string{first.Addr, second.Addr}) })
+
+	// Removed backend gets no lines and its metrics aren't reported
+	writeServers(second.Addr)
+	testutil.WaitFor(t, "second backend", func() bool { return reflect.DeepEqual(activeServers(), []string{second.Addr}) })
+	sendLines(cache, 100, 200)
+	testutil.WaitFor(t, "lines on second", func() bool { return second.Count() == 100 })
+	if first.Count() != 100 {
+		t.Errorf("Removed backend got %d lines", first.Count()-100)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := u.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if name := backendStatsName(first.Addr, ""); strings.Contains(buf.String(), name) {
+		t.Errorf("Metrics of removed backend are reported:\n%s", buf)
+	}
+	if name := backendStatsName(second.Addr, "sendLines"); !strings.Contains(buf.String(), name) {
+		t.Errorf("Metrics of backend are not reported:\n%s", buf)
+	}
+
+	// Bad file is ignored
+	if err := ioutil.WriteFile(path, []byte("[{weight: 1}]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * u.BackendsFileInterval)
+	if servers := activeServers(); !reflect.DeepEqual(servers, []string{second.Addr}) {
+		t.Errorf("Servers after bad file are %v", servers)
+	}
+}
@@ -0,0 +1,115 @@
+package upstreams
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+)
+
+// statsValues flushes stats and returns values by metric name, backend address is replaced with '*'
+// and a non-zero value of backends is kept
+func statsValues(t *testing.T, stats io.WriterTo) map[string]float64 {
+	values := make(map[string]float64)
+	for name, value := range testutil.StatsValues(t, stats) {
+		if parts := strings.SplitN(name, ".", 3); parts[0] == "upstrems" {
+			name = "upstrems.*." + parts[2]
+		}
+		if value != 0 || values[name] == 0 {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+func TestMetrics(t *testing.T) {
+	primary := testutil.NewSink(t, "127.0.0.1:0")
+	secondary := testutil.NewSink(t, "127.0.0.1:0")
+	defer secondary.Kill()
+
+	// Shadow backend is down first, so lines are dropped until it is up
+	shadow := testutil.NewSink(t, "127.0.0.1:0")
+	shadow.Kill()
+
+	u, cache := newTestUpstream(ModePriority, primary.Addr, secondary.Addr)
+	u.DegradedLatency = time.Hour
+	u.Mirror = &Mirror{
+		Server:            shadow.Addr,
+		SampleRate:        1,
+		Queue:             queue.New(0, 1000),
+		ReconnectInterval: 10 * time.Millisecond,
+		Timeout:           time.Second,
+		Stats:             u.Stats,
+	}
+	u.Start()
+	defer u.Stop()
+
+	sendLines(cache, 0, 100)
+	testutil.WaitFor(t, "lines on primary", func() bool { return primary.Count() == 100 })
+	shadow.Start()
+	defer shadow.Kill()
+
+	// Failover makes lines wait for the switch
+	primary.Kill()
+	testutil.WaitFor(t, "primary is down", func() bool { return !u.backends[0].isAlive() })
+	sendLines(cache, 100, 200)
+	testutil.WaitFor(t, "lines on secondary", func() bool { return secondary.Count() == 100 })
+	testutil.WaitFor(t, "lines on shadow", func() bool { return shadow.Count() > 0 })
+
+	// Write error: the backend writes to a connection which is closed behind its back
+	addr, err := net.ResolveTCPAddr("tcp", secondary.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	b := u.backends[1]
+	s := b.streams[0]
+	replaceConn(s, conn)
+	s.send([]byte("metric.write_error:1|c"))
+	testutil.WaitFor(t, "requeued line", func() bool { return secondary.Count() == 101 })
+	// Partial write: the line is bigger than buffers of a backend which doesn't read
+	stalled, peer := stallConn(t)
+	defer peer.Close()
+	replaceConn(s, stalled)
+	s.send(append(bytes.Repeat([]byte("a"), 1<<20), ":1|c"...))
+	testutil.WaitFor(t, "partially written line", func() bool { return secondary.Count() == 102 })
+	// Slow write is marked by writer, it is too fast in tests
+	atomic.StoreInt64(&b.slowAt, time.Now().Add(time.Hour).UnixNano())
+	// Gauges are updated by watchDog
+	time.Sleep(3 * u.BackendReconnectInterval)
+
+	values := statsValues(t, u.Stats)
+	for name, value := range statsValues(t, u) {
+		values[name] = value
+	}
+	backendFields, unregistered := testutil.MetricFields(b)
+	if len(unregistered) > 0 {
+		t.Errorf("Backend metrics are not registered: %v", unregistered)
+	}
+	upstreamFields, unregistered := testutil.MetricFields(u)
+	if len(unregistered) > 0 {
+		t.Errorf("Upstream metrics are not registered: %v", unregistered)
+	}
+	mirrorFields, unregistered := testutil.MetricFields(u.Mirror)
+	if len(unregistered) > 0 {
+		t.Errorf("Mirror metrics are not registered: %v", unregistered)
+	}
+	if declared := len(backendFields) + len(upstreamFields) + len(mirrorFields); len(values) != declared {
+		t.Errorf("%d metrics are flushed, %d are declared: %v", len(values), declared, values)
+	}
+	for name, value := range values {
+		if value == 0 {
+			t.Errorf("Metric %s is not updated", name)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package upstreams
+
+import (
+	"hash/fnv"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+// Mirror sends a copy of a part of traffic to a shadow backend.
+// The shadow backend never becomes active and doesn't take part in failover.
+// When it is slow or unavailable lines are dropped instead of blocking the main traffic.
+type Mirror struct {
+	Server string
+	// Fraction of metric names in (0, 1] that should be mirrored. Sampling is made by metric name hash,
+	// so all lines of the mirrored metric are sent to the shadow backend.
+	SampleRate float64
+	// Only metrics which names match Pattern are mirrored if it is set
+	Pattern *regexp.Regexp
+	// Lines are dropped when Queue is full, it may be limited by lines or by bytes
+	Queue             *queue.Queue
+	ReconnectInterval time.Duration
+	// Timeout of connect and of every write, shadow backend which doesn't read is disconnected after it
+	Timeout time.Duration
+	Stats   *graphite.Graphite
+	Log     *logger.Logger
+
+	done chan struct{}
+	wg   sync.WaitGroup
+	// mu guards conn, it is closed by Stop to interrupt a stalled write
+	mu           sync.Mutex
+	conn         *net.TCPConn
+	statsDropped *graphite.Counter
+	statsSent    *graphite.Counter
+}
+
+// Start mirror
+func (m *Mirror) Start() {
+	if m.Log == nil {
+		m.Log = logger.Nop()
+	}
+	m.done = make(chan struct{})
+	m.statsDropped = m.Stats.NewCounter("mirror.dropped")
+	m.statsSent = m.Stats.NewCounter("mirror.sendBytes")
+	m.wg.Add(1)
+	go m.sendData()
+}
+
+// Stop mirror, lines which are not sent yet are dropped
+func (m *Mirror) Stop() {
+	close(m.done)
+	m.mu.Lock()
+	if m.conn != nil {
+		m.conn.Close()
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// Send puts line to mirror queue if it is matched. It never blocks.
+func (m *Mirror) Send(line []byte) {
+	if !m.match(line) {
+		return
+	}
+	if !m.Queue.TryPut(line) {
+		m.statsDropped.Add(1)
+	}
+}
+
+func (m *Mirror) match(line []byte) bool {
+	name := metricName(line)
+	if m.Pattern != nil && !m.Pattern.Match(name) {
+		return false
+	}
+	if m.SampleRate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write(name)
+	return float64(mix64(h.Sum64())>>11)/(1<<53) < m.SampleRate
+}
+
+func (m *Mirror) sendData() {
+	defer m.wg.Done()
+	var (
+		conn        *net.TCPConn
+		lastAttempt time.Time
+	)
+	for {
+		select {
+		case <-m.done:
+			m.setConn(nil)
+			return
+		default:
+		}
+		line, ok := m.Queue.Get()
+		if !ok {
+			select {
+			case <-m.done:
+				m.setConn(nil)
+				return
+			case <-m.Queue.Ready():
+			}
+			continue
+		}
+		if conn == nil {
+			if time.Since(lastAttempt) < m.ReconnectInterval {
+				m.statsDropped.Add(1)
+				continue
+			}
+			lastAttempt = time.Now()
+			var err error
+			if conn, err = m.connect(); err != nil {
+				m.Log.Debug("Mirror connect fail", "mirror", m.Server, "error", err)
+				m.statsDropped.Add(1)
+				continue
+			}
+			m.Log.Info("Mirror connect successfully", "mirror", m.Server)
+		}
+		if m.Timeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(m.Timeout))
+		}
+		n, err := conn.Write(append(line[:len(line):len(line)], '\n'))
+		if err != nil {
+			m.Log.Info("Mirror is disconnected", "mirror", m.Server, "error", err)
+			m.setConn(nil)
+			conn = nil
+			m.statsDropped.Add(1)
+			continue
+		}
+		m.statsSent.Add(float64(n))
+	}
+}
+
+// connect dials shadow backend, connection made after Stop is closed at once
+func (m *Mirror) connect() (*net.TCPConn, error) {
+	c, err := net.DialTimeout("tcp", m.Server, m.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*net.TCPConn)
+	conn.SetNoDelay(false)
+	conn.SetKeepAlive(true)
+	if !m.setConn(conn) {
+		return nil, errStopped
+	}
+	return conn, nil
+}
+
+// setConn closes the current connection and replaces it with conn.
+// Returns false and closes conn if mirror is stopped.
+func (m *Mirror) setConn(conn *net.TCPConn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != nil {
+		m.conn.Close()
+	}
+	m.conn = conn
+	select {
+	case <-m.done:
+		if conn != nil {
+			conn.Close()
+			m.conn = nil
+		}
+		return false
+	default:
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package upstreams
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+func TestMirrorMatch(t *testing.T) {
+	m := &Mirror{SampleRate: 1, Pattern: regexp.MustCompile(`^api\.`)}
+	for line, expected := range map[string]bool{
+		"api.requests:1|c":   true,
+		"api.latency 10 100": true,
+		"web.requests:1|c":   false,
+		"apix.requests:1|c":  false,
+	} {
+		if matched := m.match([]byte(line)); matched != expected {
+			t.Errorf("Line [%s] is matched %v, expected %v", line, matched, expected)
+		}
+	}
+
+	// All lines of a sampled metric are mirrored
+	m = &Mirror{SampleRate: 0.25}
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		name := fmt.Sprintf("metric.%d", i)
+		matched := m.match([]byte(name + ":1|c"))
+		if again := m.match([]byte(name + ":2|ms|@0.5")); again != matched {
+			t.Fatalf("Lines of metric [%s] are sampled differently", name)
+		}
+		if matched {
+			sampled++
+		}
+	}
+	if sampled < 2200 || sampled > 2800 {
+		t.Errorf("%d of 10000 metrics are sampled with rate 0.25", sampled)
+	}
+}
+
+func TestMirrorDropWhenFull(t *testing.T) {
+	stats := graphite.New("", nil)
+	// Line of 10 bytes takes 11 bytes of queue
+	m := &Mirror{SampleRate: 1, Queue: queue.New(22, 0), statsDropped: stats.NewCounter("mirror.dropped")}
+	for i := 0; i < 5; i++ {
+		m.Send([]byte("metric:1|c"))
+	}
+	if lines := m.Queue.Len(); lines != 2 {
+		t.Errorf("Queue has %d lines, expected 2", lines)
+	}
+	if dropped := statsValues(t, stats)["mirror.dropped"]; dropped != 3 {
+		t.Errorf("Dropped counter is %v, expected 3", dropped)
+	}
+}
+
+func TestMirrorStopStalled(t *testing.T) {
+	// Shadow backend accepts connection, but never reads
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	// Queue of mirror is limited by memory, it holds about 16 of the big lines
+	m := &Mirror{
+		Server:     l.Addr().String(),
+		SampleRate: 1,
+		Queue:      queue.New(1<<20, 0),
+		Timeout:    time.Hour,
+		Stats:      graphite.New("", nil),
+	}
+	m.Start()
+	line := append(bytes.Repeat([]byte("a"), 64*1024), ":1|c"...)
+	var conn net.Conn
+	deadline := time.Now().Add(5 * time.Second)
+	// Write blocks when socket buffers are full, then queue is filled up
+	for conn == nil || m.Queue.Used()+int64(len(line)) <= m.Queue.MaxBytes() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for stalled mirror")
+		}
+		m.Send(line)
+		select {
+		case conn = <-accepted:
+			defer conn.Close()
+		default:
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m.Send(line)
+	if used := m.Queue.Used(); used > m.Queue.MaxBytes() {
+		t.Errorf("Mirror queue uses %d bytes, limit is %d", used, m.Queue.MaxBytes())
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop hangs on stalled mirror")
+	}
+}
+
+func TestMirrorWriteTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	m := &Mirror{
+		Server:     l.Addr().String(),
+		SampleRate: 1,
+		Queue:      queue.New(0, 100),
+		Timeout:    50 * time.Millisecond,
+		Stats:      graphite.New("", nil),
+	}
+	m.Start()
+	defer m.Stop()
+	line := append(bytes.Repeat([]byte("a"), 64*1024), ":1|c"...)
+	// Stalled write times out and line is dropped, connect can't fail here
+	dropped := 0.0
+	testutil.WaitFor(t, "write timeout", func() bool {
+		m.Send(line)
+		dropped += statsValues(t, m.Stats)["mirror.dropped"]
+		return dropped > 0
+	})
+}
@@ -0,0 +1,221 @@
+package upstreams
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stream is one connection of backend with its own queue and writer goroutine.
+// Lines of a metric go to the same stream while it is alive, so their order is kept.
+type stream struct {
+	backend *backend
+	index   int
+	queue   chan []byte
+
+	// 1 when conn is established, read by dispatcher without locking mu
+	alive    int32
+	mu       sync.Mutex
+	conn     *net.TCPConn
+	uptime   int64
+	downtime int64
+	// Connect fails since the last connection, Connect isn't tried before nextRetry
+	failures  int
+	lastError error
+	nextRetry time.Time
+}
+
+func newStream(b *backend, index int) *stream {
+	return &stream{
+		backend:  b,
+		index:    index,
+		queue:    make(chan []byte, b.upstream.BackendQueueSize),
+		downtime: time.Now().Unix(),
+		uptime:   time.Now().Unix(),
+	}
+}
+
+func (s *stream) isAlive() bool {
+	return atomic.LoadInt32(&s.alive) == 1
+}
+
+// Connect dials stream if it isn't connected. After a fail the next dial is delayed with exponential backoff.
+func (s *stream) Connect() error {
+	b := s.backend
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		return nil
+	}
+	// Connection made after Stop would never be closed
+	select {
+	case <-b.done:
+		return errStopped
+	default:
+	}
+	if time.Now().Before(s.nextRetry) {
+		return errRetryLater
+	}
+	b.statsReconnects.Add(1)
+	// Timeout includes resolving of host
+	c, err := net.DialTimeout("tcp", b.server, b.timeout)
+	if err != nil {
+		b.statsConnectErrors.Add(1)
+		s.failures++
+		s.lastError = err
+		s.nextRetry = time.Now().Add(backoff(b.upstream.BackendReconnectInterval, b.upstream.BackendReconnectMaxInterval, s.failures))
+		return err
+	}
+	conn := c.(*net.TCPConn)
+	conn.SetNoDelay(false)
+	conn.SetKeepAlive(true)
+
+	s.conn = conn
+	s.uptime = time.Now().Unix()
+	s.failures = 0
+	s.lastError = nil
+	s.nextRetry = time.Time{}
+	atomic.StoreInt32(&s.alive, 1)
+	b.streamIsUp()
+	b.upstream.wg.Add(1)
+	go s.watchConn(conn)
+	b.upstream.backendIsUp()
+	return nil
+}
+
+// ConnectionState is state of one connection of backend
+type ConnectionState struct {
+	Alive     bool       `json:"alive"`
+	Queued    int        `json:"queued"`
+	Failures  int        `json:"failures"`
+	LastError string     `json:"last_error,omitempty"`
+	NextRetry *time.Time `json:"next_retry,omitempty"`
+	Uptime    time.Time  `json:"uptime"`
+	Downtime  time.Time  `json:"downtime"`
+}
+
+func (s *stream) state() ConnectionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := ConnectionState{
+		Alive:    s.conn != nil,
+		Queued:   len(s.queue),
+		Failures: s.failures,
+		Uptime:   time.Unix(s.uptime, 0),
+		Downtime: time.Unix(s.downtime, 0),
+	}
+	if s.lastError != nil {
+		state.LastError = s.lastError.Error()
+	}
+	if s.conn == nil && !s.nextRetry.IsZero() {
+		nextRetry := s.nextRetry
+		state.NextRetry = &nextRetry
+	}
+	return state
+}
+
+// retryAt returns time of the next connect, zero time if stream is connected
+func (s *stream) retryAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		return time.Time{}
+	}
+	return s.nextRetry
+}
+
+// watchConn detects connection closed by the server. Statsd servers never write anything to clients,
+// so the first read returns an error when the connection is closed and lines aren't written to a dead socket.
+func (s *stream) watchConn(conn *net.TCPConn) {
+	defer s.backend.upstream.wg.Done()
+	buf := make([]byte, 1)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if s.getConn() == conn {
+				s.backend.upstream.Log.Info("Backend is disconnected", "backend", s.backend.server, "connection", s.index, "error", err)
+				s.disconnect(conn)
+			}
+			return
+		}
+	}
+}
+
+// disconnect closes conn if it is still the current connection
+func (s *stream) disconnect(conn *net.TCPConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != conn {
+		return
+	}
+	atomic.StoreInt32(&s.alive, 0)
+	s.conn.Close()
+	s.conn = nil
+	s.downtime = time.Now().Unix()
+	s.backend.streamIsDown()
+}
+
+func (s *stream) getConn() *net.TCPConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// run writes lines from queue until backend is stopped, then flushes the rest of queue and closes connection
+func (s *stream) run() {
+	u := s.backend.upstream
+	defer u.wg.Done()
+	for {
+		select {
+		case line := <-s.queue:
+			u.wakeDispatcher()
+			s.send(line)
+		case <-s.backend.done:
+			for {
+				select {
+				case line := <-s.queue:
+					s.send(line)
+				default:
+					if conn := s.getConn(); conn != nil {
+						s.disconnect(conn)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *stream) send(line []byte) {
+	b := s.backend
+	conn := s.getConn()
+	if conn == nil {
+		b.upstream.requeue(line)
+		return
+	}
+	start := time.Now()
+	// Statsite which doesn't read must not stall the writer until kernel gives up
+	if b.timeout > 0 {
+		conn.SetWriteDeadline(start.Add(b.timeout))
+	}
+	n, err := conn.Write(append(line[:len(line):len(line)], '\n'))
+	b.observeLatency(time.Since(start))
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			atomic.StoreInt64(&b.slowAt, time.Now().UnixNano())
+		}
+		b.upstream.Log.Info("Backend is disconnected", "backend", b.server, "connection", s.index, "error", err)
+		b.statsWriteErrors.Add(1)
+		// Rest of line can't be written to another connection, so the line is sent again as a whole.
+		// Backend drops the broken beginning unless only '\n' was lost, then it gets the line twice.
+		s.disconnect(conn)
+		if n > 0 {
+			b.statsPartialWrites.Add(1)
+		}
+		b.upstream.requeue(line)
+		return
+	}
+	b.statsSentBytes.Add(float64(n))
+	b.statsSentLines.Add(1)
+	b.upstream.Tap.Sent(line, b.server)
+}
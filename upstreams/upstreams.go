@@ -1,154 +1,675 @@
 package upstreams
 
 import (
+	"bytes"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+	"github.com/AlexAkulov/statsd-ha-proxy/tap"
 	"github.com/go-kit/kit/metrics/graphite"
-	"github.com/op/go-logging"
 )
 
-var (
-	log *logging.Logger
+const (
+	// ModePriority sends all traffic to the first available backend in the list
+	ModePriority = "priority"
+	// ModeWeighted spreads traffic between available backends proportionally to their weights.
+	// A metric is always sent to the same backend while the set of available backends is unchanged.
+	ModeWeighted = "weighted"
 )
 
-type backend struct {
-	statsActive    *graphite.Counter
-	statsSentBytes *graphite.Counter
+// BackendConfig describes one statsd server. In YAML it can be set as plain "host:port" string
+// or as map with address, weight for weighted mode, discovery type and count of connections
+type BackendConfig struct {
+	Server string `yaml:"address"`
+	Weight int    `yaml:"weight"`
+	// Empty, DiscoveryA or DiscoverySRV
+	Discovery string `yaml:"discovery,omitempty"`
+	// TCP connections to server, lines are spread between them by metric name. One if zero.
+	Connections int `yaml:"connections,omitempty"`
+}
+
+func (b *BackendConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address string
+	if err := unmarshal(&address); err == nil {
+		*b = BackendConfig{Server: address, Weight: 1}
+		return nil
+	}
+	type plain BackendConfig
+	v := plain{Weight: 1}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	*b = BackendConfig(v)
+	return nil
+}
 
-	conn     *net.TCPConn
-	server   string
-	timeout  time.Duration
-	uptime   int64
-	downtime int64
+func (b BackendConfig) MarshalYAML() (interface{}, error) {
+	if b.Weight == 1 && b.Discovery == "" && b.connections() == 1 {
+		return b.Server, nil
+	}
+	type plain BackendConfig
+	return plain(b), nil
+}
+
+func (b BackendConfig) connections() int {
+	if b.Connections <= 0 {
+		return 1
+	}
+	return b.Connections
+}
+
+// CheckBackendsList returns error if list can't be used as servers list of mode.
+// Backends of weighted mode must have positive weight, otherwise they would never get lines.
+func CheckBackendsList(list []BackendConfig, mode string) error {
+	if len(list) == 0 {
+		return fmt.Errorf("servers list is empty")
+	}
+	for _, b := range list {
+		if b.Server == "" {
+			return fmt.Errorf("server address is empty")
+		}
+		if b.Discovery != "" && b.Discovery != DiscoveryA && b.Discovery != DiscoverySRV {
+			return fmt.Errorf("unknown discovery [%s] for server [%s]", b.Discovery, b.Server)
+		}
+		if mode == ModeWeighted && b.Weight <= 0 {
+			return fmt.Errorf("bad weight [%d] for server [%s], it must be positive in weighted mode", b.Weight, b.Server)
+		}
+		if b.Connections < 0 {
+			return fmt.Errorf("bad connections [%d] for server [%s]", b.Connections, b.Server)
+		}
+	}
+	return nil
 }
 
+// Upstream dispatches lines from Queue to backends.
+// Every backend connection has its own queue and writer goroutine, so a slow backend doesn't block the others.
 type Upstream struct {
+	// mu guards backends and activeBackend
+	mu            sync.RWMutex
 	backends      []*backend
 	activeBackend *backend
-	Log           *logging.Logger
-	Stats         *graphite.Graphite
-	Channel       <-chan []byte
+	// Lines which backends failed to send, they are dispatched again before new ones
+	pendingMu sync.Mutex
+	pending   [][]byte
+	requeued  chan struct{}
+	// Signaled when a backend takes a line from its queue
+	space chan struct{}
+	// Signaled when a backend is connected
+	up        chan struct{}
+	waitTimer *time.Timer
+	done      chan struct{}
+	wg        sync.WaitGroup
+	// Last successful resolve result for every server from BackendsList
+	resolved            map[BackendConfig][]BackendConfig
+	backendsFileModTime time.Time
+	backendsFileSize    int64
+	Log                 *logger.Logger
+	Stats               *graphite.Graphite
+	// Prefix of metrics of upstream itself, "upstreams" is used if empty
+	StatsName string
+	// Prefix of Stats, metrics of backends are written by WriteTo with it
+	StatsPrefix string
+	Queue       *queue.Queue
+
+	statsSwitches      *graphite.Counter
+	statsRequeued      *graphite.Counter
+	statsAliveBackends *graphite.Gauge
+	// Time in milliseconds which lines wait for available backend or free space in queues.
+	// It isn't reset by flush, percentiles are for the whole time since start.
+	statsQueueWait *graphite.Histogram
 
 	// Эта настройка должна предотварить переключение трафика во время кратковременных сетевых неполадок.
 	// Переключение трафика произойдёт после того, как мастер будет недоступен больше заданного, этой настройкой, времени.
 	// Так же, возврат трафика на более приоритетный сервер, произойдёт не раньше, чем время соединение с сервером превысит время заданное этой настрйокой
 	SwitchLatency time.Duration
 
-	BackendsList             []string
-	BackendReconnectInterval time.Duration
-	BackendTimeout           time.Duration
+	// ModePriority or ModeWeighted, ModePriority is used if empty
+	Mode string
+	// Optional shadow backend, gets a copy of traffic
+	Mirror *Mirror
+	// Optional tap which gets every line written to backends
+	Tap *tap.Tap
+
+	BackendsList []BackendConfig
+	// Delay of reconnect after the first fail, it is doubled after every next fail up to BackendReconnectMaxInterval
+	BackendReconnectInterval    time.Duration
+	BackendReconnectMaxInterval time.Duration
+	// Timeout of connect and of every write
+	BackendTimeout time.Duration
+	// Backend is degraded when its average write latency is greater than DegradedLatency
+	// or its queue is filled more than DegradedQueue part. Degraded backends get traffic only
+	// if there are no other alive backends. In priority mode traffic is switched from degraded backend as a whole
+	// and returns not earlier than SwitchLatency after the backend was degraded last time. Zero values disable checks.
+	DegradedLatency time.Duration
+	DegradedQueue   float64
+	// Size of queue of every backend connection in lines
+	BackendQueueSize int
+	// How often servers with discovery are re-resolved
+	DiscoveryInterval time.Duration
+	// Optional YAML or JSON file with servers list, it replaces BackendsList and is reloaded on change
+	BackendsFile         string
+	BackendsFileInterval time.Duration
+	// net.LookupHost and net.LookupSRV are used if they are nil
+	LookupHost func(host string) ([]string, error)
+	LookupSRV  func(name string) ([]*net.SRV, error)
 }
 
 func (u *Upstream) Start() {
-	log = u.Log
-	u.backends = make([]*backend, len(u.BackendsList))
-	for i := len(u.BackendsList) - 1; i > -1; i-- {
-		newBackend := &backend{
-			statsSentBytes: u.Stats.NewCounter(fmt.Sprintf("upstrems.%s.sendBytes", strings.Replace(u.BackendsList[i], ".", "_", -1))),
-			server:         u.BackendsList[i],
-			timeout:        u.BackendTimeout,
-			downtime:       time.Now().Unix(),
-			uptime:         time.Now().Unix(),
-		}
-		u.backends[i] = newBackend
-
-		if err := newBackend.Connect(); err != nil {
-			log.Errorf("Connect to %s fail with error: %v", u.BackendsList[i], err)
-		} else {
-			log.Infof("Connect to %s successfully", u.BackendsList[i])
-			u.activeBackend = u.backends[i]
+	if u.Log == nil {
+		u.Log = logger.Nop()
+	}
+	if u.Mode == "" {
+		u.Mode = ModePriority
+	}
+	if u.BackendQueueSize <= 0 {
+		u.BackendQueueSize = 1000
+	}
+	if u.StatsName == "" {
+		u.StatsName = "upstreams"
+	}
+	if u.LookupHost == nil {
+		u.LookupHost = net.LookupHost
+	}
+	if u.LookupSRV == nil {
+		u.LookupSRV = lookupSRV
+	}
+	u.statsSwitches = u.Stats.NewCounter(u.StatsName + ".switches")
+	u.statsRequeued = u.Stats.NewCounter(u.StatsName + ".requeued")
+	u.statsAliveBackends = u.Stats.NewGauge(u.StatsName + ".aliveBackends")
+	u.statsQueueWait = u.Stats.NewHistogram(u.StatsName+".queueWaitMs", 50)
+	u.requeued = make(chan struct{}, 1)
+	u.space = make(chan struct{}, 1)
+	u.up = make(chan struct{}, 1)
+	u.waitTimer = time.NewTimer(0)
+	u.done = make(chan struct{})
+	u.wg.Add(3)
+	if u.BackendsFile != "" {
+		if _, err := u.loadBackendsFile(); err != nil {
+			u.Log.Error("Load servers fail, servers from config are used", "file", u.BackendsFile, "error", err)
 		}
 	}
-	if u.activeBackend == nil {
-		log.Error("No avaliable active backends")
-		u.activeBackend = u.backends[0]
-	} else {
-		log.Infof("Active backend is %s", u.activeBackend.server)
+	u.resolved = make(map[BackendConfig][]BackendConfig)
+	u.setBackends(u.resolveBackends())
+	u.updateStats()
+	u.mu.RLock()
+	if u.activeBackend == nil || !u.activeBackend.isAlive() {
+		u.Log.Error("No avaliable active backends")
+	} else if u.Mode == ModePriority {
+		u.Log.Info("Active backend is chosen", "backend", u.activeBackend.server)
+	}
+	u.mu.RUnlock()
+	if u.Mirror != nil {
+		u.Mirror.Start()
 	}
+	go u.discovery()
 	go u.watchDog()
-	go u.sendData()
+	go u.dispatch()
 }
 
+// Stop upstream and wait until backends flush their queues
 func (u *Upstream) Stop() error {
+	close(u.done)
+	u.mu.RLock()
 	for _, b := range u.backends {
 		b.Stop()
 	}
+	u.mu.RUnlock()
+	if u.Mirror != nil {
+		u.Mirror.Stop()
+	}
+	u.wg.Wait()
 	return nil
 }
 
-func (u *Upstream) sendData() {
-	for line := range u.Channel {
-		for {
-			if u.activeBackend.conn != nil {
-				n, err := u.activeBackend.conn.Write(append(line, []byte("\n")...))
-				if err == nil {
-					u.activeBackend.statsSentBytes.Add(float64(n))
-					break
-				}
-				log.Infof("%s is disconnected with error: %v", u.activeBackend.server, err)
-				u.activeBackend.conn = nil
-				u.activeBackend.downtime = time.Now().Unix()
+// WriteTo writes metrics of current backends in graphite format like Stats.WriteTo does.
+// Metrics of removed backends aren't written anymore.
+func (u *Upstream) WriteTo(w io.Writer) (int64, error) {
+	u.mu.RLock()
+	backends := u.backends
+	u.mu.RUnlock()
+	var count int64
+	for _, b := range backends {
+		n, err := b.stats.WriteTo(w)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func backendStatsName(server, name string) string {
+	return fmt.Sprintf("upstrems.%s.%s", strings.Replace(server, ".", "_", -1), name)
+}
+
+// setBackends replaces current backends with list. Existing backends are kept as is,
+// new ones are connected, vanished ones are removed from dispatching and drained.
+// Backend with changed count of connections is replaced by new one.
+func (u *Upstream) setBackends(list []BackendConfig) {
+	u.mu.RLock()
+	current := make(map[string]*backend, len(u.backends))
+	for _, b := range u.backends {
+		current[b.server] = b
+	}
+	u.mu.RUnlock()
+
+	backends := make([]*backend, len(list))
+	for i, server := range list {
+		if b, ok := current[server.Server]; ok && len(b.streams) == server.connections() {
+			backends[i] = b
+			delete(current, server.Server)
+			continue
+		}
+		b := newBackend(u, server)
+		if err := b.Connect(); err != nil {
+			u.Log.Error("Connect fail", "backend", b.server, "error", err)
+		} else {
+			u.Log.Info("Connect successfully", "backend", b.server)
+		}
+		b.start()
+		backends[i] = b
+	}
+
+	u.mu.Lock()
+	for i, b := range backends {
+		b.weight = list[i].Weight
+	}
+	u.backends = backends
+	if u.activeBackend == nil || !containsBackend(backends, u.activeBackend) {
+		u.activeBackend = nil
+		for _, b := range backends {
+			if b.isAlive() {
+				u.activeBackend = b
+				break
 			}
-			time.Sleep(u.SwitchLatency)
 		}
+		if u.activeBackend == nil && len(backends) > 0 {
+			u.activeBackend = backends[0]
+		}
+	}
+	u.mu.Unlock()
+
+	for _, b := range current {
+		u.Log.Info("Backend is removed", "backend", b.server)
+		b.Stop()
 	}
 }
 
-func (u *Upstream) watchDog() {
+func (u *Upstream) backendIsUp() {
+	select {
+	case u.up <- struct{}{}:
+	default:
+	}
+}
+
+func (u *Upstream) wakeDispatcher() {
+	select {
+	case u.space <- struct{}{}:
+	default:
+	}
+}
+
+// requeue gives line back to dispatcher, it never blocks
+func (u *Upstream) requeue(line []byte) {
+	u.statsRequeued.Add(1)
+	u.pendingMu.Lock()
+	u.pending = append(u.pending, line)
+	u.pendingMu.Unlock()
+	select {
+	case u.requeued <- struct{}{}:
+	default:
+	}
+}
+
+func (u *Upstream) takePending() [][]byte {
+	u.pendingMu.Lock()
+	defer u.pendingMu.Unlock()
+	pending := u.pending
+	u.pending = nil
+	return pending
+}
+
+func (u *Upstream) dispatch() {
+	defer u.wg.Done()
 	for {
-		time.Sleep(u.BackendReconnectInterval)
-		priority := len(u.backends)
-		for i, backend := range u.backends {
-			if err := backend.Connect(); err == nil {
-				log.Debugf("%s OK", backend.server)
-				if i < priority {
-					priority = i
-				}
-			} else {
-				log.Debugf("%s Fail with error: %v", backend.server, err)
+		select {
+		case <-u.done:
+			return
+		default:
+		}
+		for _, line := range u.takePending() {
+			if !u.dispatchLine(line) {
+				return
 			}
 		}
-		if priority == len(u.backends) {
-			log.Errorf("All backends down")
+		if line, ok := u.Queue.Get(); ok {
+			if u.Mirror != nil {
+				u.Mirror.Send(line)
+			}
+			if !u.dispatchLine(line) {
+				return
+			}
 			continue
 		}
-		if u.activeBackend == nil {
-			u.activeBackend = u.backends[priority]
-			log.Infof("Now active backend is %s", u.activeBackend.server)
+		select {
+		case <-u.done:
+			return
+		case <-u.requeued:
+		case <-u.Queue.Ready():
+		}
+	}
+}
+
+// dispatchLine puts line to a backend queue, waits while there are no available backends
+// or queues of all available backends are full. Returns false if upstream is stopped.
+func (u *Upstream) dispatchLine(line []byte) bool {
+	var waitStart time.Time
+	for {
+		u.mu.RLock()
+		queued, alive := u.tryDispatch(line)
+		u.mu.RUnlock()
+		if queued {
+			if !waitStart.IsZero() {
+				u.statsQueueWait.Observe(float64(time.Since(waitStart)) / float64(time.Millisecond))
+			}
+			return true
+		}
+		if waitStart.IsZero() {
+			waitStart = time.Now()
+		}
+		if !alive {
+			select {
+			case <-u.done:
+				return false
+			case <-u.up:
+				// Watchdog chooses active backend in priority mode
+				if u.Mode != ModeWeighted {
+					u.reconnect()
+				}
+			case <-time.After(u.SwitchLatency):
+			}
 			continue
 		}
-		if u.activeBackend.server != u.backends[priority].server {
-			log.Infof("Switch backend from %s to %s", u.activeBackend.server, u.backends[priority].server)
-			u.activeBackend = u.backends[priority]
+		// Backends may go down while waiting for free space in their queues, so check them from time to time
+		if !u.waitTimer.Stop() {
+			select {
+			case <-u.waitTimer.C:
+			default:
+			}
+		}
+		u.waitTimer.Reset(u.SwitchLatency)
+		select {
+		case <-u.done:
+			return false
+		case <-u.space:
+		case <-u.waitTimer.C:
+			// Active backend doesn't read, switch from it without waiting for watchdog
+			if u.Mode != ModeWeighted {
+				u.chooseActive()
+			}
 		}
 	}
 }
 
-func (b *backend) Connect() error {
-	var (
-		addr *net.TCPAddr
-		err  error
-	)
-	if b.conn == nil {
-		if addr, err = net.ResolveTCPAddr("tcp", b.server); err != nil {
-			return err
+// tryDispatch puts line to queue of a backend without blocking.
+// Returns whether line is queued and whether there is at least one available backend.
+// Must be called with u.mu held.
+func (u *Upstream) tryDispatch(line []byte) (queued bool, alive bool) {
+	now := time.Now()
+	if u.Mode != ModeWeighted {
+		b := u.activeBackend
+		if b == nil || !b.isAlive() {
+			return false, false
 		}
-		if b.conn, err = net.DialTCP("tcp", nil, addr); err != nil {
-			return err
+		// Degraded active backend is switched by watchdog, not line by line, so lines of a metric go to one backend
+		return b.put(line), true
+	}
+	// Weighted rendezvous hashing by metric name. When a backend goes down
+	// only its own metrics are moved to the rest of backends.
+	// If queue of the chosen backend is full the line goes to the next one, so a slow backend doesn't block the others.
+	name := metricName(line)
+	var full map[*backend]bool
+	// Degraded backends are used only if there are no less degraded ones
+	maxLevel := degradedNone
+	for {
+		var (
+			picked    *backend
+			bestScore float64
+		)
+		for _, b := range u.backends {
+			if full[b] || b.weight <= 0 || !b.isAlive() || b.degradation(now) > maxLevel {
+				continue
+			}
+			h := fnv.New64a()
+			h.Write([]byte(b.server))
+			h.Write(name)
+			// FNV spreads the last bytes badly over the high bits, so mix it before mapping to (0, 1)
+			x := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+			score := float64(b.weight) / -math.Log(x)
+			if picked == nil || score > bestScore {
+				picked = b
+				bestScore = score
+			}
+		}
+		if picked == nil {
+			if maxLevel < degradedSlow {
+				maxLevel++
+				continue
+			}
+			return false, len(full) != 0
+		}
+		if picked.put(line) {
+			return true, true
 		}
-		b.conn.SetNoDelay(false)
-		b.conn.SetKeepAlive(true)
+		if full == nil {
+			full = make(map[*backend]bool)
+		}
+		full[picked] = true
+	}
+}
 
-		b.uptime = time.Now().Unix()
+// metricName returns name of statsd metric or path of graphite metric
+func metricName(line []byte) []byte {
+	if pos := bytes.IndexAny(line, ": "); pos != -1 {
+		return line[:pos]
 	}
-	return nil
+	return line
 }
 
-func (b *backend) Stop() {
-	if b.conn != nil {
-		b.conn.Close()
+// mix64 is the splitmix64 finalizer
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// minReconnectWait limits how often watchdog wakes up for retries of backends
+const minReconnectWait = 10 * time.Millisecond
+
+func (u *Upstream) watchDog() {
+	defer u.wg.Done()
+	timer := time.NewTimer(u.BackendReconnectInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-timer.C:
+		}
+		u.reconnect()
+		u.updateStats()
+		timer.Reset(u.nextReconnect())
+	}
+}
+
+// nextReconnect returns time until the earliest retry of a backend which is down,
+// but not more than BackendReconnectInterval, so priority of backends is checked regularly.
+func (u *Upstream) nextReconnect() time.Duration {
+	u.mu.RLock()
+	backends := u.backends
+	u.mu.RUnlock()
+	wait := u.BackendReconnectInterval
+	for _, b := range backends {
+		retryAt := b.retryAt()
+		if retryAt.IsZero() {
+			continue
+		}
+		if d := time.Until(retryAt); d < wait {
+			wait = d
+		}
+	}
+	if wait < minReconnectWait {
+		wait = minReconnectWait
+	}
+	return wait
+}
+
+// Backends returns state of every backend
+func (u *Upstream) Backends() []BackendState {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	states := make([]BackendState, len(u.backends))
+	for i, b := range u.backends {
+		states[i] = b.state()
+		states[i].Weight = b.weight
+		states[i].Active = states[i].Alive && (u.Mode == ModeWeighted || b == u.activeBackend)
+	}
+	return states
+}
+
+// reconnect connects backends which are down and in priority mode returns traffic to the most priority alive backend
+func (u *Upstream) reconnect() {
+	u.mu.RLock()
+	backends := u.backends
+	u.mu.RUnlock()
+	if u.Mode == ModeWeighted {
+		for _, backend := range backends {
+			u.connect(backend)
+		}
+		return
+	}
+	tried := false
+	for _, backend := range backends {
+		err := u.connect(backend)
+		if err == nil {
+			u.Log.Debug("Backend is alive", "backend", backend.server)
+		}
+		tried = tried || err != errRetryLater
+	}
+	// Backends which wait for retry were reported on their last try
+	if !u.chooseActive() && tried {
+		u.Log.Error("All backends down")
+	}
+}
+
+// chooseActive makes the most priority of the least degraded alive backends active in priority mode.
+// Degradation is kept for SwitchLatency, so traffic isn't switched back and forth.
+// Returns false if there are no alive backends.
+func (u *Upstream) chooseActive() bool {
+	u.mu.RLock()
+	backends := u.backends
+	u.mu.RUnlock()
+	priority, level := len(backends), degradedSlow+1
+	now := time.Now()
+	for i, backend := range backends {
+		if !backend.isAlive() {
+			continue
+		}
+		if l := backend.degradation(now); l < level {
+			priority, level = i, l
+		}
+	}
+	if priority == len(backends) {
+		return false
+	}
+	u.mu.Lock()
+	if !u.hasBackend(backends[priority]) {
+		// Backends were changed by discovery meanwhile
+		u.mu.Unlock()
+		return true
+	}
+	if u.activeBackend == nil {
+		u.activeBackend = backends[priority]
+		u.Log.Info("Active backend is chosen", "backend", u.activeBackend.server)
+	} else if u.activeBackend.server != backends[priority].server {
+		u.Log.Info("Switch backend", "from", u.activeBackend.server, "to", backends[priority].server, "degraded", u.activeBackend.degradation(now) != degradedNone)
+		u.activeBackend = backends[priority]
+		u.statsSwitches.Add(1)
+	}
+	u.mu.Unlock()
+	return true
+}
+
+// connect returns error of Connect, fails are logged with time of the next retry
+func (u *Upstream) connect(b *backend) error {
+	err := b.Connect()
+	if err != nil && err != errRetryLater && err != errStopped {
+		u.Log.Debug("Reconnect fail", "backend", b.server, "error", err, "retry_in", time.Until(b.retryAt()).Round(time.Millisecond))
+	}
+	return err
+}
+
+// updateStats sets gauges of upstream and its backends
+func (u *Upstream) updateStats() {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	alive := 0
+	now := time.Now()
+	for _, b := range u.backends {
+		active := 0.0
+		if b.isAlive() {
+			alive++
+			if u.Mode == ModeWeighted || b == u.activeBackend {
+				active = 1
+			}
+		}
+		b.statsActive.Set(active)
+		level := degradedNone
+		if b.isAlive() {
+			level = b.degradation(now)
+		}
+		degraded := level != degradedNone
+		if degraded != b.degradedReported {
+			b.degradedReported = degraded
+			if level == degradedSlow {
+				u.Log.Warning("Backend is degraded, writes are slow", "backend", b.server, "latency", b.averageLatency())
+			} else if degraded {
+				queued, _ := b.queued()
+				u.Log.Warning("Backend is degraded, queue is almost full", "backend", b.server, "queued", queued)
+			} else {
+				u.Log.Info("Backend is recovered", "backend", b.server)
+			}
+		}
+		if degraded {
+			b.statsDegraded.Set(1)
+		} else {
+			b.statsDegraded.Set(0)
+		}
+	}
+	u.statsAliveBackends.Set(float64(alive))
+}
+
+// hasBackend must be called with u.mu held
+func (u *Upstream) hasBackend(b *backend) bool {
+	return containsBackend(u.backends, b)
+}
+
+func containsBackend(backends []*backend, b *backend) bool {
+	for _, current := range backends {
+		if current == b {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,342 @@
+package upstreams
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/statsd-ha-proxy/internal/testutil"
+	"github.com/AlexAkulov/statsd-ha-proxy/logger"
+	"github.com/AlexAkulov/statsd-ha-proxy/queue"
+	"github.com/go-kit/kit/metrics/graphite"
+)
+
+// replaceConn makes stream write to conn, the old connection is closed
+func replaceConn(s *stream, conn *net.TCPConn) {
+	s.mu.Lock()
+	old := s.conn
+	s.conn = conn
+	s.mu.Unlock()
+	old.Close()
+}
+
+// stallConn returns connection to a peer which never reads, its buffers are small,
+// so a big line can't be written before timeout. Peer is returned to read the written part.
+func stallConn(t *testing.T) (*net.TCPConn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetWriteBuffer(4096)
+	peer, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.(*net.TCPConn).SetReadBuffer(4096)
+	return conn, peer
+}
+
+// active returns active backend of priority mode
+func (u *Upstream) active() *backend {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.activeBackend
+}
+
+func newTestUpstream(mode string, servers ...string) (*Upstream, *queue.Queue) {
+	cache := queue.New(0, 1000)
+	u := &Upstream{
+		Log:                      logger.Nop(),
+		Stats:                    graphite.New("", nil),
+		Queue:                    cache,
+		Mode:                     mode,
+		SwitchLatency:            20 * time.Millisecond,
+		BackendReconnectInterval: 50 * time.Millisecond,
+		BackendTimeout:           time.Second,
+	}
+	for _, server := range servers {
+		u.BackendsList = append(u.BackendsList, BackendConfig{Server: server, Weight: 1})
+	}
+	return u, cache
+}
+
+func sendLines(cache *queue.Queue, from, to int) {
+	for i := from; i < to; i++ {
+		cache.Put([]byte(fmt.Sprintf("metric.%d:1|c", i)), nil)
+	}
+}
+
+func TestPriorityFailover(t *testing.T) {
+	primary := testutil.NewSink(t, "127.0.0.1:0")
+	secondary := testutil.NewSink(t, "127.0.0.1:0")
+	defer secondary.Kill()
+
+	u, cache := newTestUpstream(ModePriority, primary.Addr, secondary.Addr)
+	u.Start()
+	defer u.Stop()
+
+	sendLines(cache, 0, 100)
+	testutil.WaitFor(t, "lines on primary", func() bool { return primary.Count() == 100 })
+
+	primary.Kill()
+	testutil.WaitFor(t, "primary is down", func() bool { return !u.backends[0].isAlive() })
+	sendLines(cache, 100, 200)
+	testutil.WaitFor(t, "lines on secondary", func() bool { return secondary.Count() == 100 })
+	if primary.Count() != 100 {
+		t.Errorf("Primary got %d lines after it was closed", primary.Count()-100)
+	}
+
+	// Traffic returns to primary when it is up again
+	primary.Start()
+	defer primary.Kill()
+	testutil.WaitFor(t, "switch back to primary", func() bool { return u.active() == u.backends[0] })
+	sendLines(cache, 200, 300)
+	testutil.WaitFor(t, "lines on primary", func() bool { return primary.Count() == 100 })
+	if secondary.Count() != 100 {
+		t.Errorf("Secondary got %d lines, expected 100", secondary.Count())
+	}
+}
+
+func TestAllBackendsDown(t *testing.T) {
+	first := testutil.NewSink(t, "127.0.0.1:0")
+	addr := first.Addr
+	first.Kill()
+
+	u, cache := newTestUpstream(ModePriority, addr)
+	u.Start()
+	defer u.Stop()
+
+	// Lines wait in cache until a backend is available
+	sendLines(cache, 0, 100)
+	time.Sleep(100 * time.Millisecond)
+	first.Start()
+	defer first.Kill()
+	testutil.WaitFor(t, "lines after backend is up", func() bool { return first.Count() == 100 })
+}
+
+func TestWeightedBackendDown(t *testing.T) {
+	first := testutil.NewSink(t, "127.0.0.1:0")
+	second := testutil.NewSink(t, "127.0.0.1:0")
+	defer second.Kill()
+
+	u, cache := newTestUpstream(ModeWeighted, first.Addr, second.Addr)
+	u.Start()
+	defer u.Stop()
+
+	sendLines(cache, 0, 1000)
+	testutil.WaitFor(t, "all lines", func() bool { return first.Count()+second.Count() == 1000 })
+	if first.Count() == 0 || second.Count() == 0 {
+		t.Fatalf("Lines are not spread between backends: %d and %d", first.Count(), second.Count())
+	}
+
+	before := second.Count()
+	first.Kill()
+	testutil.WaitFor(t, "first is down", func() bool { return !u.backends[0].isAlive() })
+	sendLines(cache, 0, 1000)
+	testutil.WaitFor(t, "all lines on second", func() bool { return second.Count() == before+1000 })
+}
+
+func TestWeightedSplit(t *testing.T) {
+	light := testutil.NewSink(t, "127.0.0.1:0")
+	defer light.Kill()
+	heavy := testutil.NewSink(t, "127.0.0.1:0")
+	defer heavy.Kill()
+
+	u, cache := newTestUpstream(ModeWeighted)
+	u.BackendsList = []BackendConfig{{Server: light.Addr, Weight: 1}, {Server: heavy.Addr, Weight: 3}}
+	// Lines of a full queue go to the other backend, so queues hold the whole burst
+	u.BackendQueueSize = 10000
+	u.Start()
+	defer u.Stop()
+	testutil.WaitFor(t, "backends are up", func() bool { return u.backends[0].isAlive() && u.backends[1].isAlive() })
+
+	// Every line is a distinct metric, so the split follows weights
+	sendLines(cache, 0, 4000)
+	testutil.WaitFor(t, "all lines", func() bool { return light.Count()+heavy.Count() == 4000 })
+	if share := float64(heavy.Count()) / 4000; share < 0.7 || share > 0.8 {
+		t.Errorf("Backend with weight 3 of 4 got %.2f of lines", share)
+	}
+}
+
+func TestPartialWrite(t *testing.T) {
+	statsite := testutil.NewSink(t, "127.0.0.1:0")
+	defer statsite.Kill()
+	u, _ := newTestUpstream(ModePriority, statsite.Addr)
+	u.BackendTimeout = 100 * time.Millisecond
+	u.Start()
+	defer u.Stop()
+	b := u.backends[0]
+	testutil.WaitFor(t, "backend is up", b.isAlive)
+
+	// Backend stops reading in the middle of line
+	conn, peer := stallConn(t)
+	defer peer.Close()
+	s := b.streams[0]
+	replaceConn(s, conn)
+	line := append(bytes.Repeat([]byte("a"), 1<<20), ":1|c"...)
+	s.send(line)
+
+	// Broken connection is closed, so the written part isn't continued by other lines
+	written, err := ioutil.ReadAll(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) == 0 || len(written) > len(line) {
+		t.Fatalf("%d bytes of %d are written before timeout", len(written), len(line))
+	}
+	// The whole line is sent again by the next connection
+	testutil.WaitFor(t, "line", func() bool { return statsite.Count() == 1 })
+	resent := statsite.Received()[0]
+	if resent != string(line) {
+		t.Errorf("Line of %d bytes is sent again as %d bytes", len(line), len(resent))
+	}
+	if values := statsValues(t, u); values["upstrems.*.partialWrites"] != 1 || values["upstrems.*.writeErrors"] != 1 {
+		t.Errorf("Partial write isn't counted: %v", values)
+	}
+}
+
+func TestSetBackends(t *testing.T) {
+	first := testutil.NewSink(t, "127.0.0.1:0")
+	defer first.Kill()
+	second := testutil.NewSink(t, "127.0.0.1:0")
+	defer second.Kill()
+
+	u, cache := newTestUpstream(ModePriority, first.Addr)
+	u.Start()
+	defer u.Stop()
+
+	sendLines(cache, 0, 100)
+	u.setBackends([]BackendConfig{{Server: second.Addr, Weight: 1}})
+	sendLines(cache, 100, 200)
+	testutil.WaitFor(t, "all lines", func() bool { return first.Count()+second.Count() == 200 })
+	sendLines(cache, 200, 300)
+	testutil.WaitFor(t, "new lines on new backend", func() bool { return first.Count()+second.Count() == 300 })
+	if second.Count() < 200 {
+		t.Errorf("Removed backend got lines after removing")
+	}
+}
+
+func TestConnections(t *testing.T) {
+	s := testutil.NewSink(t, "127.0.0.1:0")
+	defer s.Kill()
+
+	u, cache := newTestUpstream(ModePriority)
+	u.BackendsList = []BackendConfig{{Server: s.Addr, Weight: 1, Connections: 3}}
+	u.Start()
+	defer u.Stop()
+
+	send := func(from, to int) {
+		for i := from; i < to; i++ {
+			cache.Put([]byte(fmt.Sprintf("metric.%d:%d|c", i%10, i)), nil)
+		}
+	}
+	send(0, 300)
+	testutil.WaitFor(t, "lines", func() bool { return s.Count() == 300 })
+	conns := len(s.Conns())
+	// Lines of a metric go through one connection, so they are received in order
+	last := make(map[int]int)
+	for _, line := range s.Received() {
+		var metric, value int
+		fmt.Sscanf(line, "metric.%d:%d|c", &metric, &value)
+		if previous, ok := last[metric]; ok && value < previous {
+			t.Errorf("Line [%s] is received after value %d", line, previous)
+		}
+		last[metric] = value
+	}
+	if conns != 3 {
+		t.Fatalf("Backend has %d connections, expected 3", conns)
+	}
+
+	// Closed connection is reconnected alone
+	s.Conns()[0].Close()
+	testutil.WaitFor(t, "reconnect", func() bool {
+		return s.Connections() == 4 && atomic.LoadInt32(&u.backends[0].connected) == 3
+	})
+	send(300, 600)
+	testutil.WaitFor(t, "lines after reconnect", func() bool { return s.Count() == 600 })
+}
+
+func TestDegradedFailover(t *testing.T) {
+	primary := testutil.NewSink(t, "127.0.0.1:0")
+	defer primary.Kill()
+	secondary := testutil.NewSink(t, "127.0.0.1:0")
+	defer secondary.Kill()
+
+	u, cache := newTestUpstream(ModePriority, primary.Addr, secondary.Addr)
+	u.DegradedLatency = time.Hour
+	u.Start()
+	defer u.Stop()
+
+	atomic.StoreInt64(&u.backends[0].slowAt, time.Now().Add(time.Hour).UnixNano())
+	testutil.WaitFor(t, "switch to secondary", func() bool { return u.active() == u.backends[1] })
+	sendLines(cache, 0, 100)
+	testutil.WaitFor(t, "lines on secondary", func() bool { return secondary.Count() == 100 })
+	if primary.Count() != 0 {
+		t.Errorf("Degraded primary got %d lines", primary.Count())
+	}
+
+	// Degraded backend is still used when it is the only alive one
+	secondary.Kill()
+	testutil.WaitFor(t, "secondary is down", func() bool { return !u.backends[1].isAlive() })
+	sendLines(cache, 100, 200)
+	testutil.WaitFor(t, "lines on primary", func() bool { return primary.Count() == 100 })
+}
+
+func TestDegradedQueueSwitch(t *testing.T) {
+	primary := testutil.NewSink(t, "127.0.0.1:0")
+	defer primary.Kill()
+	secondary := testutil.NewSink(t, "127.0.0.1:0")
+	defer secondary.Kill()
+
+	u, cache := newTestUpstream(ModePriority, primary.Addr, secondary.Addr)
+	u.DegradedQueue = 0.5
+	u.SwitchLatency = 300 * time.Millisecond
+	u.Start()
+	defer u.Stop()
+	testutil.WaitFor(t, "primary is active", func() bool { return u.active() == u.backends[0] })
+
+	// Queue of primary was full just now
+	atomic.StoreInt64(&u.backends[0].queueFullAt, time.Now().UnixNano())
+	switched := time.Now()
+	testutil.WaitFor(t, "switch to secondary", func() bool { return u.active() == u.backends[1] })
+	if switches := statsValues(t, u.Stats)["upstreams.switches"]; switches != 1 {
+		t.Errorf("Switches counter is %v, expected 1", switches)
+	}
+	// All lines go to secondary, though queue of primary is empty already
+	sendLines(cache, 0, 100)
+	testutil.WaitFor(t, "lines on secondary", func() bool { return secondary.Count() == 100 })
+	if primary.Count() != 0 {
+		t.Errorf("Degraded primary got %d lines", primary.Count())
+	}
+
+	// Traffic returns to primary not earlier than SwitchLatency
+	testutil.WaitFor(t, "switch back to primary", func() bool { return u.active() == u.backends[0] })
+	if elapsed := time.Since(switched); elapsed < u.SwitchLatency {
+		t.Errorf("Switched back after %s, expected at least %s", elapsed, u.SwitchLatency)
+	}
+	sendLines(cache, 100, 200)
+	testutil.WaitFor(t, "lines on primary", func() bool { return primary.Count() == 100 })
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := 100*time.Millisecond, time.Second
+	for i, expected := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		failures := i + 1
+		expected *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			delay := backoff(base, max, failures)
+			if delay < expected/2 || delay > expected {
+				t.Fatalf("Delay after %d fails is %s, expected [%s, %s]", failures, delay, expected/2, expected)
+			}
+		}
+	}
+}